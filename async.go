@@ -0,0 +1,231 @@
+package stackdriverlog
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+const defaultAsyncQueueSize = 1024
+
+// AsyncPolicy is the policy when the queue of `AsyncSink` is full.
+type AsyncPolicy int
+
+const (
+	// AsyncBlock blocks the caller until the queue has room.
+	AsyncBlock AsyncPolicy = iota
+
+	// AsyncDropLowestSeverity drops the entry with the lowest severity in the queue or the new entry.
+	// If several entries have the lowest severity, the oldest one is dropped.
+	AsyncDropLowestSeverity
+
+	// AsyncDropNewest drops the new entry.
+	AsyncDropNewest
+)
+
+// AsyncConfig is the configuration for `AsyncSink`.
+type AsyncConfig struct {
+	// QueueSize is the max number of entries waiting to be written, including entries being written
+	// by the background goroutine. The default is 1024.
+	QueueSize int
+
+	// Policy is the policy when the queue is full.
+	Policy AsyncPolicy
+
+	// OnError is called when the underlying sink fails to write an entry.
+	// The error is written to stderr if nil.
+	OnError func(error)
+}
+
+// AsyncSink is the sink which writes entries to the underlying sink in a background goroutine,
+// so that a slow output doesn't add latency to requests.
+// `Close` must be called on shutdown to write the remaining entries.
+//
+//	sink := stackdriverlog.NewAsyncSink(stackdriverlog.NewWriterSink(os.Stdout), stackdriverlog.AsyncConfig{})
+//	defer sink.Close()
+//	config.ContextLogSink = sink
+type AsyncSink struct {
+	sink   Sink
+	config AsyncConfig
+
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	queue    []*Entry
+	inflight int           // number of entries taken from the queue and not written yet
+	writing  bool          // whether the background goroutine is writing entries taken from the queue
+	idle     chan struct{} // closed when the queue becomes empty and no entry is being written
+	closed   bool
+
+	dropped [SeverityEmergency/100 + 1]atomic.Int64 // indexed by severity / 100
+	stopped chan struct{}
+}
+
+// NewAsyncSink creates an async sink writing to sink and starts the background goroutine.
+func NewAsyncSink(sink Sink, config AsyncConfig) *AsyncSink {
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultAsyncQueueSize
+	}
+	s := &AsyncSink{
+		sink:    sink,
+		config:  config,
+		idle:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	s.notEmpty = sync.NewCond(&s.mu)
+	s.notFull = sync.NewCond(&s.mu)
+	close(s.idle)
+	go s.run()
+	return s
+}
+
+// WriteEntry implements Sink. It returns without waiting for the entry to be written,
+// unless the queue is full and the policy is AsyncBlock.
+func (s *AsyncSink) WriteEntry(entry *Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for !s.closed && len(s.queue)+s.inflight >= s.config.QueueSize {
+		switch s.config.Policy {
+		case AsyncDropNewest:
+			s.drop(entry)
+			return nil
+		case AsyncDropLowestSeverity:
+			if len(s.queue) == 0 {
+				// entries being written can't be dropped
+				s.drop(entry)
+				return nil
+			}
+			lowest := 0
+			for i, e := range s.queue {
+				if e.Severity < s.queue[lowest].Severity {
+					lowest = i
+				}
+			}
+			if entry.Severity <= s.queue[lowest].Severity {
+				s.drop(entry)
+				return nil
+			}
+			s.drop(s.queue[lowest])
+			s.queue = append(s.queue[:lowest], s.queue[lowest+1:]...)
+		default:
+			s.notFull.Wait()
+		}
+	}
+	if s.closed {
+		return ErrWriterClosed
+	}
+
+	if len(s.queue) == 0 && !s.writing {
+		s.idle = make(chan struct{})
+	}
+	s.queue = append(s.queue, entry)
+	s.notEmpty.Signal()
+	return nil
+}
+
+// drop counts the dropped entry. It must be called with the lock.
+func (s *AsyncSink) drop(entry *Entry) {
+	i := int(entry.Severity) / 100
+	if i < 0 || i >= len(s.dropped) {
+		i = 0
+	}
+	s.dropped[i].Add(1)
+}
+
+// Dropped returns the number of entries dropped because the queue was full.
+func (s *AsyncSink) Dropped() int64 {
+	var n int64
+	for i := range s.dropped {
+		n += s.dropped[i].Load()
+	}
+	return n
+}
+
+// DroppedBySeverity returns the number of dropped entries by severity.
+func (s *AsyncSink) DroppedBySeverity() map[Severity]int64 {
+	dropped := make(map[Severity]int64)
+	for i := range s.dropped {
+		if n := s.dropped[i].Load(); n > 0 {
+			dropped[Severity(i*100)] = n
+		}
+	}
+	return dropped
+}
+
+// Flush waits until all queued entries are written to the underlying sink, or ctx is done.
+func (s *AsyncSink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	idle := s.idle
+	s.mu.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close writes all queued entries and stops the background goroutine.
+// Entries written after Close are rejected with ErrWriterClosed.
+func (s *AsyncSink) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.notEmpty.Broadcast()
+	s.notFull.Broadcast()
+	s.mu.Unlock()
+
+	<-s.stopped
+	return nil
+}
+
+func (s *AsyncSink) run() {
+	defer close(s.stopped)
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && !s.closed {
+			s.notEmpty.Wait()
+		}
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			return
+		}
+		entries := s.queue
+		s.queue = nil
+		s.inflight = len(entries)
+		s.writing = true
+		s.mu.Unlock()
+
+		for _, entry := range entries {
+			if err := s.sink.WriteEntry(entry); err != nil {
+				s.handleError(err)
+			}
+			// the room is made only after the entry is written to bound the entries in memory
+			s.mu.Lock()
+			s.inflight--
+			s.notFull.Signal()
+			s.mu.Unlock()
+		}
+
+		s.mu.Lock()
+		s.writing = false
+		if len(s.queue) == 0 {
+			close(s.idle)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *AsyncSink) handleError(err error) {
+	if s.config.OnError != nil {
+		s.config.OnError(err)
+		return
+	}
+	fmt.Fprintln(os.Stderr, err.Error())
+}
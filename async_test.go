@@ -0,0 +1,152 @@
+package stackdriverlog
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// blockingSink blocks writes until unblocked
+type blockingSink struct {
+	recordingSink
+	unblock chan struct{}
+}
+
+func (s *blockingSink) WriteEntry(entry *Entry) error {
+	<-s.unblock
+	return s.recordingSink.WriteEntry(entry)
+}
+
+func (s *blockingSink) messages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var messages []string
+	for _, entry := range s.entries {
+		messages = append(messages, entry.Message())
+	}
+	return messages
+}
+
+func newAsyncTestEntry(severity Severity, msg string) *Entry {
+	return &Entry{Severity: severity, Payload: map[string]interface{}{"message": msg}}
+}
+
+func TestAsyncSinkPolicy(t *testing.T) {
+	tests := []struct {
+		name             string
+		policy           AsyncPolicy
+		expectedMessages []string
+		expectedDropped  map[Severity]int64
+	}{
+		{
+			"drop newest",
+			AsyncDropNewest,
+			[]string{"first", "debug", "error"},
+			map[Severity]int64{SeverityInfo: 1, SeverityWarning: 1},
+		},
+		{
+			"drop lowest severity",
+			AsyncDropLowestSeverity,
+			[]string{"first", "error", "warning"},
+			map[Severity]int64{SeverityDebug: 1, SeverityInfo: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := &blockingSink{unblock: make(chan struct{})}
+			sink := NewAsyncSink(inner, AsyncConfig{QueueSize: 3, Policy: tt.policy})
+
+			// the first entry is taken by the background goroutine and blocks it, leaving room for 2 entries
+			sink.WriteEntry(newAsyncTestEntry(SeverityInfo, "first"))
+			waitUntil(t, func() bool {
+				sink.mu.Lock()
+				defer sink.mu.Unlock()
+				return sink.writing
+			})
+
+			for _, entry := range []*Entry{
+				newAsyncTestEntry(SeverityDebug, "debug"),
+				newAsyncTestEntry(SeverityError, "error"),
+				newAsyncTestEntry(SeverityInfo, "info"),
+				newAsyncTestEntry(SeverityWarning, "warning"),
+			} {
+				if err := sink.WriteEntry(entry); err != nil {
+					t.Fatal(err)
+				}
+			}
+			close(inner.unblock)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := sink.Flush(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(inner.messages(), tt.expectedMessages) {
+				t.Errorf("diff: %s", cmp.Diff(inner.messages(), tt.expectedMessages))
+			}
+			if !cmp.Equal(sink.DroppedBySeverity(), tt.expectedDropped) {
+				t.Errorf("diff: %s", cmp.Diff(sink.DroppedBySeverity(), tt.expectedDropped))
+			}
+			if sink.Dropped() != 2 {
+				t.Errorf("unexpected dropped: %d", sink.Dropped())
+			}
+			sink.Close()
+		})
+	}
+}
+
+func TestAsyncSinkBlock(t *testing.T) {
+	inner := &blockingSink{unblock: make(chan struct{})}
+	sink := NewAsyncSink(inner, AsyncConfig{QueueSize: 2})
+
+	// the entry being written still counts for the queue size
+	sink.WriteEntry(newAsyncTestEntry(SeverityInfo, "1"))
+	waitUntil(t, func() bool {
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		return sink.writing
+	})
+	sink.WriteEntry(newAsyncTestEntry(SeverityInfo, "2"))
+
+	written := make(chan struct{})
+	go func() {
+		sink.WriteEntry(newAsyncTestEntry(SeverityInfo, "3"))
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatal("write is not blocked")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := sink.Flush(ctx); err != context.DeadlineExceeded {
+		t.Errorf("unexpected flush error: %v", err)
+	}
+
+	close(inner.unblock)
+	<-written
+	sink.Close()
+	expected := []string{"1", "2", "3"}
+	if !cmp.Equal(inner.messages(), expected) {
+		t.Errorf("diff: %s", cmp.Diff(inner.messages(), expected))
+	}
+	if err := sink.WriteEntry(newAsyncTestEntry(SeverityInfo, "4")); err != ErrWriterClosed {
+		t.Errorf("unexpected error after close: %v", err)
+	}
+}
+
+func waitUntil(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,212 @@
+package stackdriverlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// BufferConfig is the configuration to buffer context logs in memory until the end of the request.
+// At the end of the request, all buffered logs are written if the request is failed or slow.
+// Otherwise the buffered logs are handled as specified by Fallback.
+type BufferConfig struct {
+	// FlushSeverity is the max severity of the request to write all buffered logs.
+	// The default is ERROR.
+	FlushSeverity Severity
+
+	// FlushStatus is the minimum status code of the request to write all buffered logs.
+	// The default is 500.
+	FlushStatus int
+
+	// FlushLatency is the minimum latency of the request to write all buffered logs.
+	// If zero, latency is not considered.
+	FlushLatency time.Duration
+
+	// Fallback is the action for the buffered logs when none of the conditions above is met.
+	Fallback BufferAction
+
+	// MaxBytes is the max size of the buffered logs per request, estimated as the size of JSON.
+	// The default is 1 MiB.
+	MaxBytes int
+
+	// Overflow is the policy when the buffered logs exceed MaxBytes.
+	Overflow BufferOverflowPolicy
+}
+
+// BufferAction is the action for the buffered logs at the end of the request.
+type BufferAction int
+
+const (
+	// BufferWriteAboveSeverity writes only buffered logs at or above `Config.Severity`.
+	BufferWriteAboveSeverity BufferAction = iota
+
+	// BufferDiscard discards all buffered logs.
+	BufferDiscard
+
+	// bufferWriteAll writes all buffered logs, used when the request is failed or slow
+	bufferWriteAll BufferAction = -1
+)
+
+// samplingBuffer holds context logs of a request until the sampler decides, when `Config.Buffer` is nil.
+// The size is limited to the default of MaxBytes, which is documented on `Sampler`.
+var samplingBuffer = &BufferConfig{}
+
+// BufferOverflowPolicy is the policy when the buffered logs exceed the max size.
+type BufferOverflowPolicy int
+
+const (
+	// BufferDropOldest drops the oldest logs to buffer the new one.
+	BufferDropOldest BufferOverflowPolicy = iota
+
+	// BufferDropNewest drops the new log.
+	BufferDropNewest
+)
+
+const defaultBufferMaxBytes = 1 << 20
+
+type bufferedEntry struct {
+	entry *Entry
+	size  int
+}
+
+// logBuffer holds context logs of the request. It must be accessed with the lock of the root logger.
+type logBuffer struct {
+	config      *BufferConfig
+	entries     []bufferedEntry
+	size        int
+	dropped     int
+	maxSeverity Severity
+}
+
+func (b *logBuffer) add(entry *Entry) {
+	maxBytes := b.config.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultBufferMaxBytes
+	}
+	if entry.Severity > b.maxSeverity {
+		b.maxSeverity = entry.Severity
+	}
+
+	// the values may be modified by the caller until the buffer is flushed
+	entry.Payload = snapshotPayload(entry.Payload)
+	size := approximateSize(entry)
+	if b.size+size > maxBytes {
+		if b.config.Overflow == BufferDropNewest {
+			b.dropped++
+			return
+		}
+		for len(b.entries) > 0 && b.size+size > maxBytes {
+			b.size -= b.entries[0].size
+			b.entries = b.entries[1:]
+			b.dropped++
+		}
+		if size > maxBytes {
+			b.dropped++
+			return
+		}
+	}
+	b.entries = append(b.entries, bufferedEntry{entry, size})
+	b.size += size
+}
+
+// snapshotPayload returns a deep copy of the payload by marshalling it. Numbers are kept as `json.Number`
+// so that they are written as they are.
+func snapshotPayload(payload map[string]interface{}) map[string]interface{} {
+	b, err := marshalPayload(payload)
+	if err != nil {
+		return payload
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var snapshot map[string]interface{}
+	if err := dec.Decode(&snapshot); err != nil {
+		return payload
+	}
+	return snapshot
+}
+
+// shouldFlushAll reports whether all buffered logs should be written.
+func (c *BufferConfig) shouldFlushAll(maxSeverity Severity, status int, elapsed time.Duration) bool {
+	flushSeverity := c.FlushSeverity
+	if flushSeverity == SeverityDefault {
+		flushSeverity = SeverityError
+	}
+	flushStatus := c.FlushStatus
+	if flushStatus == 0 {
+		flushStatus = 500
+	}
+	return maxSeverity >= flushSeverity ||
+		status >= flushStatus ||
+		(c.FlushLatency > 0 && elapsed >= c.FlushLatency)
+}
+
+// startBuffering makes the logger buffer logs until `flushBuffer` is called.
+// If all is true, logs at any severity are buffered so that they can be written when the request fails.
+func (l *ContextLogger) startBuffering(config *BufferConfig, all bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buffer = &logBuffer{config: config}
+	l.buffering.Store(all)
+}
+
+// bufferedMaxSeverity returns the max severity of logs buffered so far.
+func (l *ContextLogger) bufferedMaxSeverity() Severity {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buffer == nil {
+		return SeverityDefault
+	}
+	return l.buffer.maxSeverity
+}
+
+// flushBuffer writes the buffered logs as specified by the action and stops buffering.
+// Logs written after this are not buffered.
+func (l *ContextLogger) flushBuffer(action BufferAction) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	buffer := l.buffer
+	if buffer == nil {
+		return nil
+	}
+	l.buffer = nil
+	l.buffering.Store(false)
+
+	if action == BufferDiscard {
+		return nil
+	}
+	all := action == bufferWriteAll
+
+	var firstErr error
+	for _, buffered := range buffer.entries {
+		if !all && buffered.entry.Severity < l.Severity {
+			continue
+		}
+		l.recordSeverity(buffered.entry.Severity)
+		if err := l.sink.WriteEntry(buffered.entry); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if all && buffer.dropped > 0 {
+		payload := map[string]interface{}{
+			"message": fmt.Sprintf("%d log entries were dropped because the buffer was full", buffer.dropped),
+		}
+		if len(l.AdditionalData) > 0 {
+			payload["data"] = l.AdditionalData
+		}
+		l.recordSeverity(SeverityWarning)
+		err := l.sink.WriteEntry(&Entry{
+			Severity:     SeverityWarning,
+			Time:         time.Now(),
+			Trace:        l.Trace,
+			SpanId:       l.SpanId,
+			TraceSampled: l.TraceSampled,
+			Payload:      payload,
+		})
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
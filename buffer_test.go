@@ -0,0 +1,172 @@
+package stackdriverlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// writeBufferTestLogs writes the logs of the buffer tests, so that their sizes are the same in all tests.
+func writeBufferTestLogs(logger *ContextLogger, logError bool) {
+	logger.Debugf("debug")
+	logger.Infof("info")
+	if logError {
+		logger.Errorf("error")
+	}
+}
+
+// overflowBytes returns the buffer size which can hold any two of the logs written by writeBufferTestLogs,
+// but not all of them. The size of each log is measured as it's buffered, i.e. `approximateSize`.
+func overflowBytes(t *testing.T) int {
+	contextLogSink := &recordingSink{}
+	config := NewConfig("test")
+	config.RequestLogOut = new(bytes.Buffer)
+	config.ContextLogSink = contextLogSink
+	config.Severity = SeverityDebug
+	handler := RequestLogging(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeBufferTestLogs(RequestContextLogger(r), true)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/foo", nil))
+
+	if len(contextLogSink.entries) != 3 {
+		t.Fatalf("unexpected number of logs: %d", len(contextLogSink.entries))
+	}
+	total, smallest := 0, approximateSize(contextLogSink.entries[0])
+	for _, entry := range contextLogSink.entries {
+		size := approximateSize(entry)
+		total += size
+		smallest = min(smallest, size)
+	}
+	return total - smallest/2
+}
+
+func TestBuffer(t *testing.T) {
+	maxBytes := overflowBytes(t)
+	tests := []struct {
+		name             string
+		buffer           *BufferConfig
+		status           int
+		logError         bool
+		sleep            time.Duration
+		expectedMessages []string
+		expectedSeverity string
+	}{
+		{
+			"successful request writes logs above severity",
+			&BufferConfig{},
+			200, false, 0,
+			[]string{"info"},
+			"INFO",
+		},
+		{
+			"successful request discards logs",
+			&BufferConfig{Fallback: BufferDiscard},
+			200, false, 0,
+			nil,
+			"INFO",
+		},
+		{
+			"error log flushes all logs",
+			&BufferConfig{Fallback: BufferDiscard},
+			200, true, 0,
+			[]string{"debug", "info", "error"},
+			"ERROR",
+		},
+		{
+			"error status flushes all logs",
+			&BufferConfig{Fallback: BufferDiscard},
+			503, false, 0,
+			[]string{"debug", "info"},
+			"INFO",
+		},
+		{
+			"slow request flushes all logs",
+			&BufferConfig{Fallback: BufferDiscard, FlushLatency: 10 * time.Millisecond},
+			200, false, 20 * time.Millisecond,
+			[]string{"debug", "info"},
+			"INFO",
+		},
+		{
+			"overflow drops oldest logs",
+			&BufferConfig{MaxBytes: maxBytes},
+			500, true, 0,
+			[]string{"info", "error", "1 log entries were dropped because the buffer was full"},
+			"ERROR",
+		},
+		{
+			"overflow drops newest logs",
+			&BufferConfig{MaxBytes: maxBytes, Overflow: BufferDropNewest},
+			500, true, 0,
+			[]string{"debug", "info", "1 log entries were dropped because the buffer was full"},
+			"ERROR",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/foo", nil)
+			w := httptest.NewRecorder()
+
+			requestLogOut := new(bytes.Buffer)
+			contextLogOut := new(bytes.Buffer)
+
+			config := NewConfig("test")
+			config.RequestLogOut = requestLogOut
+			config.ContextLogOut = contextLogOut
+			config.Buffer = tt.buffer
+			handler := RequestLogging(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				writeBufferTestLogs(RequestContextLogger(r), tt.logError)
+				time.Sleep(tt.sleep)
+				w.WriteHeader(tt.status)
+			}))
+			handler.ServeHTTP(w, r)
+
+			var messages []string
+			for _, log := range strings.Split(strings.TrimSpace(contextLogOut.String()), "\n") {
+				if log == "" {
+					continue
+				}
+				var cLog contextLog
+				if err := json.Unmarshal([]byte(log), &cLog); err != nil {
+					t.Fatal(err)
+				}
+				messages = append(messages, cLog.Message)
+			}
+			if !cmp.Equal(messages, tt.expectedMessages) {
+				t.Errorf("diff: %s", cmp.Diff(messages, tt.expectedMessages))
+			}
+
+			var httpRequestLog HttpRequestLog
+			if err := json.Unmarshal(requestLogOut.Bytes(), &httpRequestLog); err != nil {
+				t.Fatal(err)
+			}
+			if httpRequestLog.Severity != tt.expectedSeverity {
+				t.Errorf("unexpected severity: got %s, want %s", httpRequestLog.Severity, tt.expectedSeverity)
+			}
+		})
+	}
+}
+
+func TestBufferSnapshotsValues(t *testing.T) {
+	contextLogOut := new(bytes.Buffer)
+	config := NewConfig("test")
+	config.RequestLogOut = new(bytes.Buffer)
+	config.ContextLogOut = contextLogOut
+	config.Buffer = &BufferConfig{}
+	handler := RequestLogging(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := map[string]interface{}{"name": "alice"}
+		RequestContextLogger(r).InfoKV("hello", "user", user, "count", 1)
+		user["name"] = "bob"
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if !strings.Contains(contextLogOut.String(), `"user":{"name":"alice"}`) || !strings.Contains(contextLogOut.String(), `"count":1`) {
+		t.Errorf("unexpected log: %s", contextLogOut.String())
+	}
+}
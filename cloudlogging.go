@@ -0,0 +1,431 @@
+package stackdriverlog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultCloudLoggingEndpoint = "https://logging.googleapis.com/v2/entries:write"
+	defaultCloudLoggingLogName  = "app"
+	defaultBatchSize            = 100
+	defaultFlushInterval        = time.Second
+	defaultMaxBufferedEntries   = 10000
+	defaultMaxRetries           = 5
+	defaultInitialBackoff       = 500 * time.Millisecond
+	defaultRequestTimeout       = 30 * time.Second
+	maxBackoff                  = 30 * time.Second
+
+	metadataTokenUrl = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// ErrWriterClosed is returned when writing to the closed writer or sink.
+var ErrWriterClosed = errors.New("stackdriverlog: writer is closed")
+
+// MonitoredResource is the resource which produces logs. More details:
+// https://cloud.google.com/logging/docs/reference/v2/rest/v2/MonitoredResource
+type MonitoredResource struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// CloudLoggingConfig is the configuration for `CloudLoggingWriter`.
+type CloudLoggingConfig struct {
+	ProjectId string
+
+	// LogName is the id of the log, e.g. "app" for `projects/PROJECT_ID/logs/app`. The default is "app".
+	LogName string
+
+	// Resource is the monitored resource of entries. The default is the "global" resource.
+	Resource *MonitoredResource
+
+	// Labels are added to all entries.
+	Labels map[string]string
+
+	// Client is used to call the API. It must add the credentials to requests,
+	// e.g. a client created by `golang.org/x/oauth2/google.DefaultClient`.
+	// If nil, the access token is fetched from the metadata server, which works on GCE, GKE and Cloud Run.
+	Client *http.Client
+
+	// Endpoint is the URL of entries.write method. The default is the Cloud Logging API.
+	Endpoint string
+
+	// BatchSize is the maximum number of entries sent in a request. The default is 100.
+	BatchSize int
+
+	// FlushInterval is the interval to send buffered entries. The default is 1 second.
+	FlushInterval time.Duration
+
+	// MaxBufferedEntries is the maximum number of entries waiting to be sent.
+	// New entries are dropped if the buffer is full. The default is 10000.
+	MaxBufferedEntries int
+
+	// MaxRetries is the number of retries of a request failed with 429, 5xx or a network error.
+	// The default is 5.
+	MaxRetries int
+
+	// InitialBackoff is the wait before the first retry, which is doubled for each retry.
+	// The default is 500 milliseconds.
+	InitialBackoff time.Duration
+
+	// RequestTimeout is the timeout of each request to the API, including fetching the access token.
+	// The default is 30 seconds.
+	RequestTimeout time.Duration
+
+	// OnError is called when entries couldn't be sent. The error is written to stderr if nil.
+	OnError func(error)
+}
+
+// CloudLoggingWriter is the sink which sends logs to Cloud Logging API directly.
+// It can be used as `Config.RequestLogSink` and `Config.ContextLogSink` where no logging agent is available.
+// It's also an io.Writer, where each line written is parsed as a structured log and mapped to LogEntry fields
+// such as trace, spanId, sourceLocation, httpRequest and severity.
+//
+// Entries are sent in batches by a background goroutine. `Close` must be called on shutdown
+// to send the remaining entries.
+type CloudLoggingWriter struct {
+	config   CloudLoggingConfig
+	endpoint string
+	logName  string
+	resource *MonitoredResource
+	client   *http.Client
+
+	mu      sync.Mutex // guards pending and closed
+	pending []*apiLogEntry
+	closed  bool
+	sendMu  sync.Mutex // serializes sending
+
+	dropped atomic.Int64
+	notify  chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// NewCloudLoggingWriter creates a writer and starts the background goroutine.
+func NewCloudLoggingWriter(config CloudLoggingConfig) *CloudLoggingWriter {
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultBatchSize
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = defaultFlushInterval
+	}
+	if config.MaxBufferedEntries <= 0 {
+		config.MaxBufferedEntries = defaultMaxBufferedEntries
+	}
+	if config.MaxRetries <= 0 {
+		config.MaxRetries = defaultMaxRetries
+	}
+	if config.InitialBackoff <= 0 {
+		config.InitialBackoff = defaultInitialBackoff
+	}
+	if config.RequestTimeout <= 0 {
+		config.RequestTimeout = defaultRequestTimeout
+	}
+
+	w := &CloudLoggingWriter{
+		config:   config,
+		endpoint: config.Endpoint,
+		resource: config.Resource,
+		client:   config.Client,
+		notify:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	if w.endpoint == "" {
+		w.endpoint = defaultCloudLoggingEndpoint
+	}
+	logName := config.LogName
+	if logName == "" {
+		logName = defaultCloudLoggingLogName
+	}
+	w.logName = fmt.Sprintf("projects/%s/logs/%s", config.ProjectId, logName)
+	if w.resource == nil {
+		w.resource = &MonitoredResource{Type: "global"}
+	}
+	if w.client == nil {
+		w.client = &http.Client{Transport: &metadataTokenTransport{base: http.DefaultTransport}}
+	}
+
+	go w.run()
+	return w
+}
+
+// WriteEntry implements Sink
+func (w *CloudLoggingWriter) WriteEntry(entry *Entry) error {
+	return w.add(newApiLogEntry(entry))
+}
+
+// Write parses each line of p as a log entry and buffers it.
+// A line which isn't a JSON object is sent as textPayload.
+func (w *CloudLoggingWriter) Write(p []byte) (int, error) {
+	var entries []*apiLogEntry
+	for _, line := range bytes.Split(p, []byte{'\n'}) {
+		if line = bytes.TrimSpace(line); len(line) == 0 {
+			continue
+		}
+		if entry, err := ParseEntry(line); err == nil {
+			entries = append(entries, newApiLogEntry(entry))
+		} else {
+			entries = append(entries, &apiLogEntry{TextPayload: string(line)})
+		}
+	}
+	if err := w.add(entries...); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// add buffers the entries, and notifies the background goroutine if a batch is full.
+func (w *CloudLoggingWriter) add(entries ...*apiLogEntry) error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return ErrWriterClosed
+	}
+	for _, entry := range entries {
+		if len(w.pending) >= w.config.MaxBufferedEntries {
+			w.dropped.Add(1)
+			continue
+		}
+		w.pending = append(w.pending, entry)
+	}
+	full := len(w.pending) >= w.config.BatchSize
+	w.mu.Unlock()
+
+	if full {
+		select {
+		case w.notify <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Dropped returns the number of entries dropped because the buffer was full.
+func (w *CloudLoggingWriter) Dropped() int64 {
+	return w.dropped.Load()
+}
+
+// Flush sends all buffered entries.
+func (w *CloudLoggingWriter) Flush() error {
+	w.sendMu.Lock()
+	defer w.sendMu.Unlock()
+
+	w.mu.Lock()
+	entries := w.pending
+	w.pending = nil
+	w.mu.Unlock()
+
+	var errs []error
+	for len(entries) > 0 {
+		n := min(len(entries), w.config.BatchSize)
+		if err := w.send(entries[:n]); err != nil {
+			errs = append(errs, err)
+		}
+		entries = entries[n:]
+	}
+	return errors.Join(errs...)
+}
+
+// Close stops the background goroutine and sends the remaining entries.
+func (w *CloudLoggingWriter) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	w.mu.Unlock()
+
+	close(w.done)
+	<-w.stopped
+	return w.Flush()
+}
+
+func (w *CloudLoggingWriter) run() {
+	defer close(w.stopped)
+	ticker := time.NewTicker(w.config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		case <-w.notify:
+		}
+		if err := w.Flush(); err != nil {
+			w.handleError(err)
+		}
+	}
+}
+
+func (w *CloudLoggingWriter) handleError(err error) {
+	if w.config.OnError != nil {
+		w.config.OnError(err)
+		return
+	}
+	fmt.Fprintln(os.Stderr, err.Error())
+}
+
+// send calls entries.write with retries.
+func (w *CloudLoggingWriter) send(entries []*apiLogEntry) error {
+	body, err := json.Marshal(&writeEntriesRequest{
+		LogName:        w.logName,
+		Resource:       w.resource,
+		Labels:         w.config.Labels,
+		Entries:        entries,
+		PartialSuccess: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	backoff := w.config.InitialBackoff
+	for attempt := 0; ; attempt++ {
+		retryable, err := w.post(body)
+		if err == nil {
+			return nil
+		}
+		if !retryable || attempt >= w.config.MaxRetries {
+			return fmt.Errorf("stackdriverlog: failed to write %d entries: %w", len(entries), err)
+		}
+		time.Sleep(backoff)
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// post sends the request once. It returns whether the error is retryable.
+func (w *CloudLoggingWriter) post(body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), w.config.RequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode == http.StatusOK {
+		return false, nil
+	}
+	retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retryable, fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+}
+
+// writeEntriesRequest is the request body of entries.write. More details:
+// https://cloud.google.com/logging/docs/reference/v2/rest/v2/entries/write
+type writeEntriesRequest struct {
+	LogName        string             `json:"logName"`
+	Resource       *MonitoredResource `json:"resource"`
+	Labels         map[string]string  `json:"labels,omitempty"`
+	Entries        []*apiLogEntry     `json:"entries"`
+	PartialSuccess bool               `json:"partialSuccess"`
+}
+
+// apiLogEntry is the LogEntry of Cloud Logging API. More details:
+// https://cloud.google.com/logging/docs/reference/v2/rest/v2/LogEntry
+type apiLogEntry struct {
+	Timestamp      string            `json:"timestamp,omitempty"`
+	Severity       string            `json:"severity,omitempty"`
+	HttpRequest    *HttpRequest      `json:"httpRequest,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	Trace          string            `json:"trace,omitempty"`
+	SpanId         string            `json:"spanId,omitempty"`
+	TraceSampled   bool              `json:"traceSampled,omitempty"`
+	SourceLocation *SourceLocation   `json:"sourceLocation,omitempty"`
+	JsonPayload    jsonPayload       `json:"jsonPayload,omitempty"`
+	TextPayload    string            `json:"textPayload,omitempty"`
+}
+
+// jsonPayload is marshalled per entry so that a value which can't be marshalled doesn't fail the whole batch.
+type jsonPayload map[string]interface{}
+
+func (p jsonPayload) MarshalJSON() ([]byte, error) {
+	return marshalPayload(p)
+}
+
+// newApiLogEntry maps the entry to LogEntry in the same way as the logging agent maps structured logs.
+func newApiLogEntry(entry *Entry) *apiLogEntry {
+	e := &apiLogEntry{
+		Severity:     entry.Severity.String(),
+		HttpRequest:  entry.HttpRequest,
+		Labels:       entry.Labels,
+		Trace:        entry.Trace,
+		SpanId:       entry.SpanId,
+		TraceSampled: entry.TraceSampled,
+		JsonPayload:  entry.Payload,
+	}
+	if !entry.Time.IsZero() {
+		e.Timestamp = entry.Time.Format(time.RFC3339Nano)
+	}
+	if entry.SourceLocation != nil && *entry.SourceLocation != (SourceLocation{}) {
+		e.SourceLocation = entry.SourceLocation
+	}
+	return e
+}
+
+// metadataTokenTransport adds the access token of the default service account fetched from the metadata server.
+type metadataTokenTransport struct {
+	base http.RoundTripper
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func (t *metadataTokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.accessToken(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(req)
+}
+
+func (t *metadataTokenTransport) accessToken(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// refresh the token a bit before it expires
+	if t.token != "" && time.Now().Add(time.Minute).Before(t.expiry) {
+		return t.token, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadataTokenUrl, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get access token from metadata server: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get access token from metadata server: status %d", resp.StatusCode)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	t.token = token.AccessToken
+	t.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return t.token, nil
+}
@@ -0,0 +1,220 @@
+package stackdriverlog
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeLoggingServer records requests of entries.write
+type fakeLoggingServer struct {
+	mu       sync.Mutex
+	requests []writeEntriesRequest
+	failures int // number of requests to fail with 503
+}
+
+func (s *fakeLoggingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	var req writeEntriesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.requests = append(s.requests, req)
+	w.Write([]byte("{}"))
+}
+
+func (s *fakeLoggingServer) entries() []*apiLogEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entries []*apiLogEntry
+	for _, req := range s.requests {
+		entries = append(entries, req.Entries...)
+	}
+	return entries
+}
+
+func newTestCloudLoggingWriter(t *testing.T, fake *fakeLoggingServer) *CloudLoggingWriter {
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return NewCloudLoggingWriter(CloudLoggingConfig{
+		ProjectId:      "test",
+		Client:         server.Client(),
+		Endpoint:       server.URL,
+		BatchSize:      2,
+		FlushInterval:  time.Hour,
+		InitialBackoff: time.Millisecond,
+		OnError:        func(err error) { t.Error(err) },
+	})
+}
+
+func TestCloudLoggingWriter(t *testing.T) {
+	fake := &fakeLoggingServer{}
+	w := newTestCloudLoggingWriter(t, fake)
+
+	w.Write([]byte(`{"time":"2024-01-01T00:00:00Z","logging.googleapis.com/trace":"projects/test/traces/a","logging.googleapis.com/spanId":"b","logging.googleapis.com/trace_sampled":true,"logging.googleapis.com/sourceLocation":{"file":"main.go","line":"10","function":"main.main"},"severity":"INFO","message":"hello","user":"alice"}` + "\n"))
+	w.Write([]byte(`{"time":"2024-01-01T00:00:01Z","logging.googleapis.com/trace":"projects/test/traces/a","severity":"WARNING","httpRequest":{"requestMethod":"GET","status":200}}` + "\n" + "plain text\n"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.requests) != 2 {
+		t.Fatalf("unexpected number of requests: %d", len(fake.requests))
+	}
+	if fake.requests[0].LogName != "projects/test/logs/app" || fake.requests[0].Resource.Type != "global" {
+		t.Errorf("unexpected request: %+v", fake.requests[0])
+	}
+
+	expected := []*apiLogEntry{
+		{
+			Timestamp:      "2024-01-01T00:00:00Z",
+			Severity:       "INFO",
+			Trace:          "projects/test/traces/a",
+			SpanId:         "b",
+			TraceSampled:   true,
+			SourceLocation: &SourceLocation{File: "main.go", Line: "10", Function: "main.main"},
+			JsonPayload:    map[string]interface{}{"message": "hello", "user": "alice"},
+		},
+		{
+			Timestamp:   "2024-01-01T00:00:01Z",
+			Severity:    "WARNING",
+			Trace:       "projects/test/traces/a",
+			HttpRequest: &HttpRequest{RequestMethod: "GET", Status: 200},
+		},
+		{
+			TextPayload: "plain text",
+		},
+	}
+	if !cmp.Equal(fake.entries(), expected) {
+		t.Errorf("diff: %s", cmp.Diff(fake.entries(), expected))
+	}
+
+	if _, err := w.Write([]byte("after close\n")); err != ErrWriterClosed {
+		t.Errorf("unexpected error after close: %v", err)
+	}
+}
+
+func TestCloudLoggingWriterRetry(t *testing.T) {
+	fake := &fakeLoggingServer{failures: 2}
+	w := newTestCloudLoggingWriter(t, fake)
+
+	w.Write([]byte(`{"severity":"INFO","message":"hello"}` + "\n"))
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if entries := fake.entries(); len(entries) != 1 {
+		t.Errorf("unexpected number of entries: %d", len(entries))
+	}
+	w.Close()
+}
+
+func TestCloudLoggingWriterBatch(t *testing.T) {
+	fake := &fakeLoggingServer{}
+	w := newTestCloudLoggingWriter(t, fake)
+	defer w.Close()
+
+	// a full batch is sent by the background goroutine without waiting for the flush interval
+	w.Write([]byte(strings.Repeat(`{"message":"hello"}`+"\n", 2)))
+	deadline := time.Now().Add(5 * time.Second)
+	for len(fake.entries()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("batch is not sent")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCloudLoggingWriterUnmarshalableValue(t *testing.T) {
+	fake := &fakeLoggingServer{}
+	w := newTestCloudLoggingWriter(t, fake)
+	defer w.Close()
+
+	w.WriteEntry(&Entry{Severity: SeverityInfo, Payload: map[string]interface{}{"message": "hello"}})
+	w.WriteEntry(&Entry{Severity: SeverityInfo, Payload: map[string]interface{}{"message": "chan", "ch": make(chan int)}})
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := fake.entries()
+	if len(entries) != 2 {
+		t.Fatalf("unexpected number of entries: %d", len(entries))
+	}
+	if ch, ok := entries[1].JsonPayload["ch"].(string); !ok || !strings.HasPrefix(ch, "0x") {
+		t.Errorf("value is not replaced with the text representation: %+v", entries[1].JsonPayload)
+	}
+}
+
+func TestCloudLoggingWriterRequestTimeout(t *testing.T) {
+	blocked := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-blocked
+	}))
+	defer server.Close()
+	defer close(blocked)
+
+	w := NewCloudLoggingWriter(CloudLoggingConfig{
+		ProjectId:      "test",
+		Client:         server.Client(),
+		Endpoint:       server.URL,
+		FlushInterval:  time.Hour,
+		MaxRetries:     1,
+		InitialBackoff: time.Millisecond,
+		RequestTimeout: 50 * time.Millisecond,
+		OnError:        func(err error) {},
+	})
+	defer w.Close()
+
+	w.Write([]byte(`{"message":"hello"}` + "\n"))
+	done := make(chan error, 1)
+	go func() { done <- w.Flush() }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("no error for the timed out request")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request doesn't time out")
+	}
+}
+
+func TestCloudLoggingWriterSink(t *testing.T) {
+	fake := &fakeLoggingServer{}
+	w := newTestCloudLoggingWriter(t, fake)
+
+	config := NewConfig("test")
+	config.RequestLogSink = w
+	config.ContextLogSink = w
+	handler := RequestLogging(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		RequestContextLogger(r).Info("hello")
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/foo", nil))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := fake.entries()
+	if len(entries) != 2 {
+		t.Fatalf("unexpected number of entries: %d", len(entries))
+	}
+	if entries[0].JsonPayload["message"] != "hello" || entries[0].SourceLocation == nil {
+		t.Errorf("unexpected context log: %+v", entries[0])
+	}
+	if entries[1].HttpRequest == nil || entries[1].HttpRequest.RequestUrl != "/foo" {
+		t.Errorf("unexpected request log: %+v", entries[1])
+	}
+	if entries[0].Trace == "" || entries[0].Trace != entries[1].Trace {
+		t.Errorf("different trace: %s, %s", entries[0].Trace, entries[1].Trace)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/yfuruyama/stackdriver-request-context-log"
+)
+
+// filter selects groups to be shown. Zero values match everything.
+type filter struct {
+	severity log.Severity
+	status   string // e.g. "404" or "5xx"
+	path     string // prefix of the request path
+	since    time.Time
+	until    time.Time
+}
+
+func newFilter(severity, status, path, since, until string, now time.Time) (*filter, error) {
+	f := &filter{path: path}
+	if severity != "" {
+		s, err := log.ParseSeverity(severity)
+		if err != nil {
+			return nil, err
+		}
+		f.severity = s
+	}
+	if status != "" {
+		status = strings.ToLower(status)
+		if _, err := strconv.Atoi(strings.TrimSuffix(status, "xx")); err != nil || (len(status) != 3) {
+			return nil, fmt.Errorf("invalid status: %q", status)
+		}
+		f.status = status
+	}
+	var err error
+	if f.since, err = parseTime(since, now); err != nil {
+		return nil, err
+	}
+	if f.until, err = parseTime(until, now); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// parseTime parses RFC 3339 time, or the duration before now.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time: %q", s)
+	}
+	return now.Add(-d), nil
+}
+
+func (f *filter) match(g *group) bool {
+	if g.severity() < f.severity {
+		return false
+	}
+	t := g.time()
+	if !f.since.IsZero() && t.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && t.After(f.until) {
+		return false
+	}
+	if f.status == "" && f.path == "" {
+		return true
+	}
+
+	// status and path filters only match requests
+	if g.request == nil || g.request.HttpRequest == nil {
+		return false
+	}
+	if f.status != "" && !matchStatus(f.status, g.request.HttpRequest.Status) {
+		return false
+	}
+	if f.path != "" {
+		u, err := url.ParseRequestURI(g.request.HttpRequest.RequestUrl)
+		if err != nil || !strings.HasPrefix(u.Path, f.path) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchStatus(pattern string, status int) bool {
+	code := strconv.Itoa(status)
+	if strings.HasSuffix(pattern, "xx") {
+		return len(code) == 3 && code[0] == pattern[0]
+	}
+	return code == pattern
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	log "github.com/yfuruyama/stackdriver-request-context-log"
+)
+
+// group is a request log and its context logs, or context logs without the request log.
+type group struct {
+	trace    string
+	request  *log.Entry
+	entries  []*log.Entry
+	received time.Time // when the first entry is read
+}
+
+// time returns the time of the request log, or the first context log.
+func (g *group) time() time.Time {
+	if g.request != nil {
+		return g.request.Time
+	}
+	if len(g.entries) > 0 {
+		return g.entries[0].Time
+	}
+	return time.Time{}
+}
+
+// severity returns the severity of the request log, or the max severity of context logs.
+func (g *group) severity() log.Severity {
+	if g.request != nil {
+		return g.request.Severity
+	}
+	var severity log.Severity
+	for _, entry := range g.entries {
+		severity = max(severity, entry.Severity)
+	}
+	return severity
+}
+
+// grouper groups entries by trace.
+type grouper struct {
+	groups map[string]*group
+	retain bool     // whether completed groups are kept in done
+	done   []*group // groups without trace, or completed by the request log
+}
+
+// newGrouper creates a grouper. If retain is true, completed groups are kept to be returned by `all`,
+// otherwise they are only returned by `add`, e.g. to be printed immediately in follow mode.
+func newGrouper(retain bool) *grouper {
+	return &grouper{groups: make(map[string]*group), retain: retain}
+}
+
+// add adds the entry, and returns the group if it's completed by the entry.
+func (g *grouper) add(entry *log.Entry, now time.Time) *group {
+	if entry.Trace == "" {
+		done := &group{entries: []*log.Entry{entry}, received: now}
+		g.complete(done)
+		return done
+	}
+
+	current, ok := g.groups[entry.Trace]
+	if !ok {
+		current = &group{trace: entry.Trace, received: now}
+		g.groups[entry.Trace] = current
+	}
+	if entry.HttpRequest == nil {
+		current.entries = append(current.entries, entry)
+		return nil
+	}
+	// a request log completes the group. Another request with the same trace starts a new group.
+	current.request = entry
+	delete(g.groups, entry.Trace)
+	g.complete(current)
+	return current
+}
+
+func (g *grouper) complete(done *group) {
+	if g.retain {
+		g.done = append(g.done, done)
+	}
+}
+
+// expired removes and returns groups waiting for the request log since before the deadline.
+func (g *grouper) expired(deadline time.Time) []*group {
+	var expired []*group
+	for trace, current := range g.groups {
+		if current.received.Before(deadline) {
+			expired = append(expired, current)
+			delete(g.groups, trace)
+		}
+	}
+	sortGroups(expired)
+	return expired
+}
+
+// all returns completed groups if retained and groups still open in order of time, and resets the grouper.
+func (g *grouper) all() []*group {
+	all := g.done
+	for _, current := range g.groups {
+		all = append(all, current)
+	}
+	sortGroups(all)
+	g.groups = make(map[string]*group)
+	g.done = nil
+	return all
+}
+
+func sortGroups(groups []*group) {
+	for _, current := range groups {
+		sort.SliceStable(current.entries, func(i, j int) bool {
+			return current.entries[i].Time.Before(current.entries[j].Time)
+		})
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].time().Before(groups[j].time())
+	})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	log "github.com/yfuruyama/stackdriver-request-context-log"
+)
+
+const testLogs = `{"time":"2024-01-01T00:00:01Z","logging.googleapis.com/trace":"projects/p/traces/aaaaaaaaaa","severity":"INFO","message":"a1"}
+{"time":"2024-01-01T00:00:02Z","logging.googleapis.com/trace":"projects/p/traces/bbbbbbbbbb","severity":"ERROR","message":"b1"}
+not json
+{"time":"2024-01-01T00:00:03Z","logging.googleapis.com/trace":"projects/p/traces/aaaaaaaaaa","severity":"INFO","httpRequest":{"requestMethod":"GET","requestUrl":"/foo?x=1","status":200,"latency":"0.001s"}}
+{"time":"2024-01-01T00:00:04Z","logging.googleapis.com/trace":"projects/p/traces/bbbbbbbbbb","severity":"ERROR","httpRequest":{"requestMethod":"POST","requestUrl":"/bar","status":503,"latency":"0.002s"}}
+{"time":"2024-01-01T00:00:05Z","logging.googleapis.com/trace":"projects/p/traces/cccccccccc","severity":"WARNING","message":"orphan"}
+`
+
+func TestView(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 10, 0, time.UTC)
+	tests := []struct {
+		name     string
+		args     [5]string // severity, status, path, since, until
+		expected []string
+	}{
+		{
+			"all",
+			[5]string{},
+			[]string{"not json", "GET /foo?x=1 200 1ms", "    a1", "POST /bar 503 2ms", "    b1", "orphan"},
+		},
+		{
+			"severity",
+			[5]string{"warning"},
+			[]string{"POST /bar 503 2ms", "    b1", "orphan"},
+		},
+		{
+			"status",
+			[5]string{"", "5xx"},
+			[]string{"POST /bar 503 2ms", "    b1"},
+		},
+		{
+			"path",
+			[5]string{"", "", "/foo"},
+			[]string{"GET /foo?x=1 200 1ms", "    a1"},
+		},
+		{
+			"time range",
+			[5]string{"", "", "", "2024-01-01T00:00:04Z", "5500ms"},
+			[]string{"POST /bar 503 2ms", "    b1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newFilter(tt.args[0], tt.args[1], tt.args[2], tt.args[3], tt.args[4], now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := new(bytes.Buffer)
+			p := &printer{w: out, console: log.NewConsoleSink(out, log.ConsoleConfig{NoColor: true}), filter: f}
+
+			g := newGrouper(true)
+			for _, line := range strings.SplitAfter(testLogs, "\n") {
+				if line != "" {
+					g.add(parseLine([]byte(line)), now)
+				}
+			}
+			for _, group := range g.all() {
+				p.print(group)
+			}
+
+			// strip time, severity and trace to compare the structure
+			var got []string
+			for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+				indent := ""
+				if strings.HasPrefix(line, "    ") {
+					indent = "    "
+				}
+				fields := strings.Fields(line)
+				switch {
+				case fields[0] == "DEFAULT":
+					fields = fields[1:]
+				case indent != "":
+					fields = fields[2:]
+				default:
+					fields = fields[3:]
+				}
+				got = append(got, indent+strings.Join(fields, " "))
+			}
+			if !cmp.Equal(got, tt.expected) {
+				t.Errorf("diff: %s", cmp.Diff(got, tt.expected))
+			}
+		})
+	}
+}
+
+func TestFollowExpired(t *testing.T) {
+	now := time.Now()
+	g := newGrouper(false)
+	g.add(parseLine([]byte(`{"logging.googleapis.com/trace":"projects/p/traces/a","message":"old"}`)), now.Add(-time.Minute))
+	g.add(parseLine([]byte(`{"logging.googleapis.com/trace":"projects/p/traces/b","message":"new"}`)), now)
+
+	expired := g.expired(now.Add(-30 * time.Second))
+	if len(expired) != 1 || expired[0].trace != "projects/p/traces/a" {
+		t.Errorf("unexpected expired groups: %+v", expired)
+	}
+	if completed := g.add(parseLine([]byte(`{"logging.googleapis.com/trace":"projects/p/traces/b","httpRequest":{"status":200}}`)), now); completed == nil || len(completed.entries) != 1 {
+		t.Errorf("unexpected completed group: %+v", completed)
+	}
+}
+
+func TestInvalidFilter(t *testing.T) {
+	for _, args := range [][5]string{{"VERBOSE"}, {"", "5x"}, {"", "", "", "yesterday"}} {
+		if _, err := newFilter(args[0], args[1], args[2], args[3], args[4], time.Now()); err == nil {
+			t.Errorf("expected error: %v", args)
+		}
+	}
+}
+
+func TestFollowGroups(t *testing.T) {
+	out := new(bytes.Buffer)
+	f, _ := newFilter("", "", "", "", "", time.Now())
+	p := &printer{w: out, console: log.NewConsoleSink(out, log.ConsoleConfig{NoColor: true}), filter: f}
+
+	lines := make(chan []byte)
+	go func() {
+		for _, line := range strings.SplitAfter(testLogs, "\n") {
+			if line != "" {
+				lines <- []byte(line)
+			}
+		}
+		close(lines)
+	}()
+	followGroups(p, lines, time.Minute)
+
+	for _, message := range []string{"not json", "GET /foo", "a1", "POST /bar", "b1", "orphan"} {
+		if n := strings.Count(out.String(), message); n != 1 {
+			t.Errorf("%q is printed %d times:\n%s", message, n, out.String())
+		}
+	}
+}
@@ -0,0 +1,188 @@
+// Command logview shows JSON logs written by stackdriverlog in the terminal,
+// with context logs nested under the request log of the same trace as Logs Explorer does.
+//
+//	logview [flags] [file ...]
+//
+// Logs are read from stdin if no file is given.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/yfuruyama/stackdriver-request-context-log"
+)
+
+const followInterval = 500 * time.Millisecond
+
+func main() {
+	var (
+		severity     = flag.String("severity", "", "show only requests at or above the severity, e.g. WARNING")
+		status       = flag.String("status", "", "show only requests with the status, e.g. 404 or 5xx")
+		path         = flag.String("path", "", "show only requests whose path starts with the prefix")
+		since        = flag.String("since", "", "show only logs since the time (RFC 3339) or the duration ago, e.g. 1h")
+		until        = flag.String("until", "", "show only logs until the time (RFC 3339) or the duration ago")
+		follow       = flag.Bool("f", false, "follow appended logs")
+		groupTimeout = flag.Duration("group-timeout", 30*time.Second, "how long context logs wait for the request log in follow mode")
+		noColor      = flag.Bool("no-color", false, "disable colors")
+	)
+	flag.Parse()
+
+	filter, err := newFilter(*severity, *status, *path, *since, *until, time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "logview: %v\n", err)
+		os.Exit(2)
+	}
+
+	p := &printer{
+		w:       os.Stdout,
+		console: log.NewConsoleSink(os.Stdout, log.ConsoleConfig{NoColor: *noColor || !isTerminal(os.Stdout)}),
+		filter:  filter,
+	}
+
+	lines := make(chan []byte)
+	var wg sync.WaitGroup
+	files := flag.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	for _, name := range files {
+		r, err := open(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "logview: %v\n", err)
+			os.Exit(1)
+		}
+		wg.Add(1)
+		go func(name string, r io.ReadCloser) {
+			defer wg.Done()
+			defer r.Close()
+			// stdin is followed until it's closed
+			if err := readLines(r, lines, *follow && name != "-"); err != nil {
+				fmt.Fprintf(os.Stderr, "logview: %s: %v\n", name, err)
+			}
+		}(name, r)
+	}
+	go func() {
+		wg.Wait()
+		close(lines)
+	}()
+
+	if *follow {
+		followGroups(p, lines, *groupTimeout)
+	} else {
+		g := newGrouper(true)
+		for line := range lines {
+			g.add(parseLine(line), time.Now())
+		}
+		for _, group := range g.all() {
+			p.print(group)
+		}
+	}
+}
+
+// followGroups prints each group as soon as its request log arrives.
+// Groups still waiting for the request log are printed when the input is closed.
+func followGroups(p *printer, lines <-chan []byte, timeout time.Duration) {
+	g := newGrouper(false)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				for _, group := range g.all() {
+					p.print(group)
+				}
+				return
+			}
+			if group := g.add(parseLine(line), time.Now()); group != nil {
+				p.print(group)
+			}
+		case now := <-ticker.C:
+			for _, group := range g.expired(now.Add(-timeout)) {
+				p.print(group)
+			}
+		}
+	}
+}
+
+func open(name string) (io.ReadCloser, error) {
+	if name == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(name)
+}
+
+// readLines sends lines of r to the channel. If follow is true, it waits for lines appended to r after EOF.
+func readLines(r io.Reader, lines chan<- []byte, follow bool) error {
+	br := bufio.NewReader(r)
+	var partial []byte
+	for {
+		line, err := br.ReadBytes('\n')
+		partial = append(partial, line...)
+		if err == io.EOF && follow {
+			time.Sleep(followInterval)
+			continue
+		}
+		if len(partial) > 0 && (err == nil || err == io.EOF) {
+			lines <- partial
+			partial = nil
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// parseLine parses the line as a log entry. A line which isn't JSON is shown as the message of DEFAULT severity.
+func parseLine(line []byte) *log.Entry {
+	entry, err := log.ParseEntry(line)
+	if err != nil {
+		return &log.Entry{Payload: map[string]interface{}{"message": string(trimNewline(line))}}
+	}
+	return entry
+}
+
+func trimNewline(b []byte) []byte {
+	for len(b) > 0 && (b[len(b)-1] == '\n' || b[len(b)-1] == '\r') {
+		b = b[:len(b)-1]
+	}
+	return b
+}
+
+// printer prints groups which match the filter.
+type printer struct {
+	w       io.Writer
+	console *log.ConsoleSink
+	filter  *filter
+}
+
+func (p *printer) print(g *group) {
+	if !p.filter.match(g) {
+		return
+	}
+	if g.request == nil {
+		for _, entry := range g.entries {
+			io.WriteString(p.w, p.console.FormatEntry(entry, true, ""))
+		}
+		return
+	}
+	io.WriteString(p.w, p.console.FormatEntry(g.request, true, ""))
+	for _, entry := range g.entries {
+		io.WriteString(p.w, p.console.FormatEntry(entry, false, "    "))
+	}
+}
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
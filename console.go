@@ -0,0 +1,297 @@
+package stackdriverlog
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Format is the output format of `Config.RequestLogOut` and `Config.ContextLogOut`.
+type Format int
+
+const (
+	// FormatJSON writes JSON lines for Cloud Logging.
+	FormatJSON Format = iota
+
+	// FormatConsole writes human-readable lines for local development with `ConsoleSink`.
+	// Both request logs and context logs are written to ContextLogOut unless either sink is set.
+	// Context logs are held only until the end of the request, so nothing needs to be flushed on shutdown.
+	FormatConsole
+)
+
+const (
+	defaultConsoleGroupTimeout = 30 * time.Second
+	consoleTimeFormat          = "15:04:05.000"
+	consoleIndent              = "    "
+	shortTraceLength           = 8
+)
+
+// ConsoleConfig is the configuration for `ConsoleSink`.
+type ConsoleConfig struct {
+	// NoColor disables colors of severities.
+	NoColor bool
+
+	// GroupTimeout is how long context logs wait for the request log of the same trace.
+	// After the timeout, they are written without the request log. The default is 30 seconds.
+	GroupTimeout time.Duration
+}
+
+// traceFlusher is implemented by sinks which hold context logs until the request log of the same trace.
+type traceFlusher interface {
+	flushTrace(trace string) error
+}
+
+// ConsoleSink is the sink which writes human-readable logs for local development.
+// Context logs are held until the request log of the same trace arrives, and written
+// indented beneath the request log, e.g.
+//
+//	12:00:00.123 WARNING   4bf92f35 GET /foo 500 12.3ms
+//	    12:00:00.120 INFO      main.go:30 hello user=alice
+//	    12:00:00.122 WARNING   main.go:31 retrying
+//
+// Context logs without trace are written immediately.
+type ConsoleSink struct {
+	w      io.Writer
+	config ConsoleConfig
+
+	mu     sync.Mutex
+	groups map[string]*consoleGroup // by trace
+
+	ungrouped bool // writes context logs immediately, used when request logs are written to another sink
+}
+
+// consoleGroup holds context logs waiting for the request log
+type consoleGroup struct {
+	entries []*Entry
+	timer   *time.Timer
+}
+
+// newConsoleSinkFor creates a console sink for FormatConsole, which is colored if w is a terminal.
+func newConsoleSinkFor(w io.Writer) *ConsoleSink {
+	return NewConsoleSink(w, ConsoleConfig{NoColor: !isTerminal(w)})
+}
+
+// NewConsoleSink creates a console sink writing to w.
+func NewConsoleSink(w io.Writer, config ConsoleConfig) *ConsoleSink {
+	if config.GroupTimeout <= 0 {
+		config.GroupTimeout = defaultConsoleGroupTimeout
+	}
+	return &ConsoleSink{
+		w:      w,
+		config: config,
+		groups: make(map[string]*consoleGroup),
+	}
+}
+
+// WriteEntry implements Sink
+func (s *ConsoleSink) WriteEntry(entry *Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry.HttpRequest != nil {
+		var group []*Entry
+		if g, ok := s.groups[entry.Trace]; ok {
+			g.timer.Stop()
+			group = g.entries
+			delete(s.groups, entry.Trace)
+		}
+		return s.writeGroup(entry, group)
+	}
+
+	if entry.Trace == "" || s.ungrouped {
+		return s.write(s.FormatEntry(entry, true, ""))
+	}
+	g, ok := s.groups[entry.Trace]
+	if !ok {
+		g = &consoleGroup{}
+		trace := entry.Trace
+		g.timer = time.AfterFunc(s.config.GroupTimeout, func() {
+			s.flushGroup(trace, g)
+		})
+		s.groups[entry.Trace] = g
+	}
+	g.entries = append(g.entries, entry)
+	return nil
+}
+
+// Close writes context logs still waiting for the request log.
+func (s *ConsoleSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	groups := make([]*consoleGroup, 0, len(s.groups))
+	for trace, g := range s.groups {
+		g.timer.Stop()
+		groups = append(groups, g)
+		delete(s.groups, trace)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].entries[0].Time.Before(groups[j].entries[0].Time)
+	})
+	for _, g := range groups {
+		if err := s.writeGroup(nil, g.entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushTrace writes the context logs of the trace without waiting for the request log,
+// used when the request log isn't written.
+func (s *ConsoleSink) flushTrace(trace string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.groups[trace]
+	if !ok {
+		return nil
+	}
+	g.timer.Stop()
+	delete(s.groups, trace)
+	return s.writeGroup(nil, g.entries)
+}
+
+// flushGroup writes the group without the request log after the timeout.
+func (s *ConsoleSink) flushGroup(trace string, g *consoleGroup) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.groups[trace] != g {
+		return
+	}
+	delete(s.groups, trace)
+	if err := s.writeGroup(nil, g.entries); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+	}
+}
+
+// writeGroup writes the request log and its context logs. If request is nil, context logs are written
+// as they are. It must be called with the lock.
+func (s *ConsoleSink) writeGroup(request *Entry, entries []*Entry) error {
+	var b strings.Builder
+	if request != nil {
+		b.WriteString(s.FormatEntry(request, true, ""))
+	}
+	for _, entry := range entries {
+		if request != nil {
+			b.WriteString(s.FormatEntry(entry, false, consoleIndent))
+		} else {
+			b.WriteString(s.FormatEntry(entry, true, ""))
+		}
+	}
+	return s.write(b.String())
+}
+
+func (s *ConsoleSink) write(text string) error {
+	_, err := io.WriteString(s.w, text)
+	return err
+}
+
+// FormatEntry formats the entry as human-readable lines. The short trace is shown if withTrace is true,
+// and every line is prefixed with indent.
+func (s *ConsoleSink) FormatEntry(entry *Entry, withTrace bool, indent string) string {
+	var b strings.Builder
+	b.WriteString(indent)
+	if !entry.Time.IsZero() {
+		b.WriteString(entry.Time.Local().Format(consoleTimeFormat))
+		b.WriteByte(' ')
+	}
+	b.WriteString(s.severity(entry.Severity))
+	b.WriteByte(' ')
+	if withTrace && entry.Trace != "" {
+		b.WriteString(shortTrace(entry.Trace))
+		b.WriteByte(' ')
+	}
+
+	if r := entry.HttpRequest; r != nil {
+		fmt.Fprintf(&b, "%s %s %d", r.RequestMethod, r.RequestUrl, r.Status)
+		if latency, err := time.ParseDuration(r.Latency); err == nil {
+			fmt.Fprintf(&b, " %s", latency.Round(100*time.Microsecond))
+		}
+	} else if loc := entry.SourceLocation; loc != nil && loc.File != "" {
+		fmt.Fprintf(&b, "%s:%s ", loc.File, loc.Line)
+	}
+
+	lines := strings.Split(strings.TrimRight(entry.Message(), "\n"), "\n")
+	b.WriteString(lines[0])
+	for _, k := range payloadKeys(entry.Payload) {
+		fmt.Fprintf(&b, " %s=%v", k, entry.Payload[k])
+	}
+	b.WriteByte('\n')
+
+	// continuation lines such as stack traces
+	if stack, ok := entry.Payload["stack_trace"].(string); ok && stack != "" {
+		lines = append(lines, strings.Split(strings.TrimRight(stack, "\n"), "\n")...)
+	}
+	for _, line := range lines[1:] {
+		b.WriteString(indent)
+		b.WriteString(consoleIndent)
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// payloadKeys returns the keys of the payload to be shown as key=value in order.
+func payloadKeys(payload map[string]interface{}) []string {
+	keys := make([]string, 0, len(payload))
+	for k := range payload {
+		switch k {
+		// data is the same for all logs, and the others are for Error Reporting
+		case "message", "data", "@type", "serviceContext", "context", "stack_trace":
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// severity returns the padded and colored severity.
+func (s *ConsoleSink) severity(severity Severity) string {
+	text := fmt.Sprintf("%-9s", severity)
+	if s.config.NoColor {
+		return text
+	}
+	var color string
+	switch {
+	case severity >= SeverityCritical:
+		color = "1;31"
+	case severity >= SeverityError:
+		color = "31"
+	case severity >= SeverityWarning:
+		color = "33"
+	case severity >= SeverityNotice:
+		color = "36"
+	case severity >= SeverityInfo:
+		color = "32"
+	case severity >= SeverityDebug:
+		color = "90"
+	default:
+		return text
+	}
+	return "\x1b[" + color + "m" + text + "\x1b[0m"
+}
+
+// shortTrace returns the first characters of the trace id in `projects/PROJECT_ID/traces/TRACE_ID`.
+func shortTrace(trace string) string {
+	if i := strings.LastIndexByte(trace, '/'); i >= 0 {
+		trace = trace[i+1:]
+	}
+	if len(trace) > shortTraceLength {
+		trace = trace[:shortTraceLength]
+	}
+	return trace
+}
+
+// isTerminal reports whether w is a terminal, used to disable colors when the output is redirected.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
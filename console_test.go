@@ -0,0 +1,127 @@
+package stackdriverlog
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// timestampPattern matches the time of console lines
+var timestampPattern = regexp.MustCompile(`\d{2}:\d{2}:\d{2}\.\d{3} `)
+
+func TestConsoleFormat(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/foo?bar=baz", nil)
+	r.Header.Set("X-Cloud-Trace-Context", "105445aa7843bc8bf206b12000100000/1;o=1")
+	w := httptest.NewRecorder()
+
+	out := new(bytes.Buffer)
+	config := NewConfig("test")
+	config.ContextLogOut = out
+	config.Format = FormatConsole
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/foo", func(w http.ResponseWriter, r *http.Request) {
+		logger := RequestContextLogger(r)
+		logger.InfoKV("hello", "user", "alice")
+		logger.Warnf("line1\nline2")
+		w.WriteHeader(http.StatusNotFound)
+	})
+	handler := RequestLogging(config)(mux)
+	handler.ServeHTTP(w, r)
+
+	got := timestampPattern.ReplaceAllString(out.String(), "")
+	got = regexp.MustCompile(` \d+(\.\d+)?[µm]?s\n`).ReplaceAllString(got, " LATENCY\n")
+	expected := "WARNING   105445aa GET /foo?bar=baz 404 LATENCY\n" +
+		"    INFO      console_test.go:31 hello user=alice\n" +
+		"    WARNING   console_test.go:32 line1\n" +
+		"        line2\n"
+	if got != expected {
+		t.Errorf("diff: %s", cmp.Diff(got, expected))
+	}
+}
+
+func TestConsoleSinkOrphanGroup(t *testing.T) {
+	out := new(bytes.Buffer)
+	sink := NewConsoleSink(out, ConsoleConfig{NoColor: true, GroupTimeout: 10 * time.Millisecond})
+
+	sink.WriteEntry(&Entry{Severity: SeverityInfo, Payload: map[string]interface{}{"message": "no trace"}})
+	sink.WriteEntry(&Entry{Severity: SeverityError, Trace: "projects/test/traces/abcdef0123456789", Payload: map[string]interface{}{"message": "orphan"}})
+
+	waitUntil(t, func() bool {
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		return len(sink.groups) == 0
+	})
+	expected := "INFO      no trace\n" +
+		"ERROR     abcdef01 orphan\n"
+	if out.String() != expected {
+		t.Errorf("diff: %s", cmp.Diff(out.String(), expected))
+	}
+}
+
+func TestConsoleSinkColor(t *testing.T) {
+	sink := NewConsoleSink(nil, ConsoleConfig{})
+	line := sink.FormatEntry(&Entry{Severity: SeverityError, Payload: map[string]interface{}{"message": "boom"}}, true, "")
+	if !strings.HasPrefix(line, "\x1b[31mERROR    \x1b[0m boom") {
+		t.Errorf("unexpected line: %q", line)
+	}
+}
+
+func TestConsoleFormatWithoutRequestLog(t *testing.T) {
+	out := new(bytes.Buffer)
+	config := NewConfig("test")
+	config.ContextLogOut = out
+	config.Format = FormatConsole
+	config.Exclude = []RequestFilter{PathPrefix("/healthz")}
+
+	handler := RequestLogging(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		RequestContextLogger(r).Info("excluded")
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/healthz", nil))
+	if got := timestampPattern.ReplaceAllString(out.String(), ""); !strings.HasSuffix(got, "excluded\n") {
+		t.Errorf("context log of the excluded request is not written at the end of the request: %q", got)
+	}
+
+	// logs outside requests don't wait for the request log
+	out.Reset()
+	logger := NewContextLogger(config)
+	logger.Trace = "projects/test/traces/105445aa7843bc8bf206b12000100000"
+	logger.Info("outside")
+	if got := timestampPattern.ReplaceAllString(out.String(), ""); !strings.HasPrefix(got, "INFO      105445aa console_test.go:") {
+		t.Errorf("unexpected context log outside requests: %q", got)
+	}
+}
+
+func TestConsoleFormatWithContextLogSink(t *testing.T) {
+	requestLogOut := new(bytes.Buffer)
+	config := NewConfig("test")
+	config.RequestLogOut = requestLogOut
+	config.ContextLogSink = &recordingSink{}
+	config.Format = FormatConsole
+
+	handler := RequestLogging(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/foo", nil))
+	if got := requestLogOut.String(); !strings.Contains(got, " GET /foo ") {
+		t.Errorf("request log is not written in the console format: %q", got)
+	}
+}
+
+func TestConsoleLogLevelOverride(t *testing.T) {
+	sink := NewConsoleSink(nil, ConsoleConfig{NoColor: true})
+	line := sink.FormatEntry(&Entry{
+		Severity:    SeverityInfo,
+		HttpRequest: &HttpRequest{RequestMethod: "GET", RequestUrl: "/foo", Status: 200},
+		Payload: map[string]interface{}{
+			"logLevelOverride": &LogLevelOverride{Severity: "DEBUG", Reason: "expired"},
+		},
+	}, false, "")
+	if expected := "INFO      GET /foo 200 logLevelOverride=DEBUG (ignored: expired)\n"; line != expected {
+		t.Errorf("diff: %s", cmp.Diff(line, expected))
+	}
+}
@@ -1,7 +1,55 @@
 package stackdriverlog
 
+import (
+	"context"
+	"sync/atomic"
+)
+
 type contextKey struct{}
 
 var (
 	contextLoggerKey = &contextKey{}
 )
+
+var (
+	// defaultFallbackLogger writes logs without trace to stdout at INFO or higher severity
+	defaultFallbackLogger = NewContextLogger(NewConfig(""))
+
+	fallbackLogger atomic.Pointer[ContextLogger]
+)
+
+// NewContext returns a copy of ctx with the logger, which is returned by `FromContext`.
+func NewContext(ctx context.Context, logger *ContextLogger) context.Context {
+	return context.WithValue(ctx, contextLoggerKey, logger)
+}
+
+// FromContext gets the request-context logger from ctx, so that functions which only take
+// a context can log with trace. If ctx doesn't have a logger, the fallback logger is returned.
+func FromContext(ctx context.Context) *ContextLogger {
+	if l, ok := loggerFromContext(ctx); ok {
+		return l
+	}
+	return FallbackLogger()
+}
+
+func loggerFromContext(ctx context.Context) (*ContextLogger, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	l, ok := ctx.Value(contextLoggerKey).(*ContextLogger)
+	return l, ok && l != nil
+}
+
+// SetFallbackLogger sets the logger used when a context has no request-context logger.
+// If logger is nil, the default fallback logger, which writes JSON to stdout at INFO or higher severity, is restored.
+func SetFallbackLogger(logger *ContextLogger) {
+	fallbackLogger.Store(logger)
+}
+
+// FallbackLogger returns the logger used when a context has no request-context logger.
+func FallbackLogger() *ContextLogger {
+	if l := fallbackLogger.Load(); l != nil {
+		return l
+	}
+	return defaultFallbackLogger
+}
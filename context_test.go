@@ -0,0 +1,63 @@
+package stackdriverlog
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFromContext(t *testing.T) {
+	contextLogOut := new(bytes.Buffer)
+	config := NewConfig("test")
+	config.RequestLogOut = new(bytes.Buffer)
+	config.ContextLogOut = contextLogOut
+
+	// a function deeper than the handler only gets the context
+	find := func(ctx context.Context) {
+		FromContext(ctx).Infof("found")
+	}
+	var trace string
+	handler := RequestLogging(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trace = RequestContextLogger(r).Trace
+		find(r.Context())
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if !strings.Contains(contextLogOut.String(), `"logging.googleapis.com/trace":"`+trace+`"`) {
+		t.Errorf("log is not grouped with the request: %s", contextLogOut.String())
+	}
+
+	logger := NewContextLogger(config)
+	if FromContext(NewContext(context.Background(), logger)) != logger {
+		t.Error("unexpected logger from the context")
+	}
+}
+
+func TestFallbackLogger(t *testing.T) {
+	if FromContext(context.Background()) != defaultFallbackLogger {
+		t.Error("default fallback logger is not returned")
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	if RequestContextLogger(r) == nil {
+		t.Fatal("nil logger is returned without the middleware")
+	}
+
+	out := new(bytes.Buffer)
+	config := NewConfig("test")
+	config.ContextLogOut = out
+	SetFallbackLogger(NewContextLogger(config))
+	defer SetFallbackLogger(nil)
+
+	RequestContextLogger(r).Warnf("without middleware")
+	if !strings.Contains(out.String(), `"message":"without middleware"`) {
+		t.Errorf("log is not written to the fallback logger: %s", out.String())
+	}
+
+	SetFallbackLogger(nil)
+	if FallbackLogger() != defaultFallbackLogger {
+		t.Error("default fallback logger is not restored")
+	}
+}
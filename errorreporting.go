@@ -0,0 +1,99 @@
+package stackdriverlog
+
+import (
+	"bytes"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// reportedErrorEventType is the `@type` which makes Error Reporting pick up the log entry.
+// https://cloud.google.com/error-reporting/docs/formatting-error-messages
+const reportedErrorEventType = "type.googleapis.com/google.devtools.clouderrorreporting.v1beta1.ReportedErrorEvent"
+
+// ServiceContext identifies the service in Error Reporting.
+type ServiceContext struct {
+	Service string `json:"service"`
+	Version string `json:"version,omitempty"`
+}
+
+type errorContext struct {
+	HttpRequest *errorHttpRequest `json:"httpRequest,omitempty"`
+}
+
+type errorHttpRequest struct {
+	Method    string `json:"method,omitempty"`
+	Url       string `json:"url,omitempty"`
+	UserAgent string `json:"userAgent,omitempty"`
+	Referrer  string `json:"referrer,omitempty"`
+	RemoteIp  string `json:"remoteIp,omitempty"`
+}
+
+// errorReport is the information to report a log entry to Error Reporting.
+type errorReport struct {
+	// stack is the stack trace in Go's format.
+	// If empty, the message of the entry must contain the stack trace.
+	stack string
+}
+
+// ReportError logs the error at ERROR severity in the format of Error Reporting,
+// with the stack trace of the calling goroutine.
+func (l *ContextLogger) ReportError(err error) {
+	if err == nil || !l.enabled(SeverityError) {
+		return
+	}
+
+	// skip frames of this function
+	l.writeEntry(SeverityError, err.Error(), nil, callerLocation(1), time.Now(), &errorReport{stack: captureStack()})
+}
+
+func newErrorHttpRequest(r *http.Request, config *Config) *errorHttpRequest {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return &errorHttpRequest{
+		Method:    r.Method,
+		Url:       scheme + "://" + r.Host + r.URL.RequestURI(),
+		UserAgent: r.UserAgent(),
+		Referrer:  r.Referer(),
+		RemoteIp:  getRemoteIp(r, config),
+	}
+}
+
+// captureStack returns the stack trace of the calling goroutine in the same format as a panic.
+// Frames of this package's loggers and log/slog are skipped so that the stack trace starts from the caller of the logger.
+func captureStack() string {
+	buf := make([]byte, 4096)
+	for {
+		n := runtime.Stack(buf, false)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	// the first line is the goroutine header, followed by pairs of the function line and the file line
+	lines := strings.Split(string(bytes.TrimSpace(buf)), "\n")
+	header, frames := lines[0], lines[1:]
+	for len(frames) >= 2 && isLoggerFrame(frames[0]) {
+		frames = frames[2:]
+	}
+	return header + "\n" + strings.Join(frames, "\n") + "\n"
+}
+
+func isLoggerFrame(function string) bool {
+	for _, prefix := range []string{
+		packagePath + ".captureStack(",
+		packagePath + ".(*ContextLogger).",
+		packagePath + ".(*SlogHandler).",
+		"log/slog.",
+	} {
+		if strings.HasPrefix(function, prefix) {
+			return true
+		}
+	}
+	return false
+}
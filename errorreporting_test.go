@@ -0,0 +1,86 @@
+package stackdriverlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReportError(t *testing.T) {
+	for _, auto := range []bool{false, true} {
+		r, _ := http.NewRequest("GET", "http://example.com/foo?bar=baz", nil)
+		r.Header.Set("User-Agent", "test")
+		r.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+
+		contextLogOut := new(bytes.Buffer)
+		config := NewConfig("test")
+		config.RequestLogOut = new(bytes.Buffer)
+		config.ContextLogOut = contextLogOut
+		config.ServiceContext = &ServiceContext{Service: "foo", Version: "1.0"}
+		config.ReportErrors = auto
+		handler := RequestLogging(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if auto {
+				RequestContextLogger(r).Errorf("boom")
+			} else {
+				RequestContextLogger(r).ReportError(errors.New("boom"))
+			}
+		}))
+		handler.ServeHTTP(w, r)
+
+		var entry struct {
+			Type           string         `json:"@type"`
+			Message        string         `json:"message"`
+			ServiceContext ServiceContext `json:"serviceContext"`
+			Context        errorContext   `json:"context"`
+			StackTrace     string         `json:"stack_trace"`
+		}
+		if err := json.Unmarshal(contextLogOut.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+
+		if entry.Type != reportedErrorEventType || entry.Message != "boom" {
+			t.Errorf("unexpected entry: @type=%s, message=%s", entry.Type, entry.Message)
+		}
+		if entry.ServiceContext != *config.ServiceContext {
+			t.Errorf("unexpected service context: %+v", entry.ServiceContext)
+		}
+		expectedRequest := &errorHttpRequest{
+			Method:    "GET",
+			Url:       "http://example.com/foo?bar=baz",
+			UserAgent: "test",
+			RemoteIp:  "192.0.2.1",
+		}
+		if !cmp.Equal(entry.Context.HttpRequest, expectedRequest) {
+			t.Errorf("diff: %s", cmp.Diff(entry.Context.HttpRequest, expectedRequest))
+		}
+
+		// the stack trace starts from the handler
+		lines := strings.Split(entry.StackTrace, "\n")
+		if len(lines) < 3 || !strings.HasPrefix(lines[0], "goroutine ") || !strings.Contains(lines[1], "TestReportError.func") {
+			t.Errorf("unexpected stack trace: %s", entry.StackTrace)
+		}
+	}
+}
+
+func TestNoReportError(t *testing.T) {
+	out := new(bytes.Buffer)
+	logger := &ContextLogger{sink: NewWriterSink(out), Severity: SeverityInfo}
+	logger.Errorf("boom")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"@type", "serviceContext", "context", "stack_trace"} {
+		if _, ok := entry[k]; ok {
+			t.Errorf("unexpected field: %s", k)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package stackdriverlog
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// RequestFilter reports whether the request matches the filter.
+type RequestFilter func(r *http.Request) bool
+
+// PathPrefix returns the filter which matches requests whose path has one of the prefixes.
+func PathPrefix(prefixes ...string) RequestFilter {
+	return func(r *http.Request) bool {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// PathRegexp returns the filter which matches requests whose path matches the regular expression.
+func PathRegexp(re *regexp.Regexp) RequestFilter {
+	return func(r *http.Request) bool {
+		return re.MatchString(r.URL.Path)
+	}
+}
+
+func isExcluded(r *http.Request, filters []RequestFilter) bool {
+	for _, f := range filters {
+		if f(r) {
+			return true
+		}
+	}
+	return false
+}
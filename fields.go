@@ -0,0 +1,154 @@
+package stackdriverlog
+
+import (
+	"fmt"
+	"time"
+)
+
+// Fields are structured fields of a log entry.
+// They are written as fields of `jsonPayload`, so they can be used for filtering in Logs Explorer.
+// Keys which collide with the reserved keys of the entry (e.g. "message", "logging.googleapis.com/trace")
+// are prefixed with "fields.".
+// Values are not copied, and may be written after the call returns with `AsyncSink` or `CloudLoggingWriter`,
+// so they must not be modified after they are passed to the logger.
+type Fields map[string]interface{}
+
+// badKey is used for a value without a key
+const badKey = "!BADKEY"
+
+// With returns a child logger which adds the fields to every log entry.
+// The child logger shares the trace, output and severity with the parent,
+// and its logs are counted for the severity of the request log.
+func (l *ContextLogger) With(fields Fields) *ContextLogger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = fieldValue(v)
+	}
+	child := l.child()
+	child.fields = merged
+	return child
+}
+
+// Named returns a child logger with the name. The name is appended to the parent's name with ".".
+// The severity of named loggers can be overridden by `SeverityVar.SetFor`.
+func (l *ContextLogger) Named(name string) *ContextLogger {
+	child := l.child()
+	if l.name != "" {
+		name = l.name + "." + name
+	}
+	child.name = name
+	return child
+}
+
+// child returns a copy of the logger which shares the root.
+func (l *ContextLogger) child() *ContextLogger {
+	return &ContextLogger{
+		sink:               l.sink,
+		Trace:              l.Trace,
+		SpanId:             l.SpanId,
+		TraceSampled:       l.TraceSampled,
+		Severity:           l.Severity,
+		AdditionalData:     l.AdditionalData,
+		serviceContext:     l.serviceContext,
+		reportErrors:       l.reportErrors,
+		errorRequest:       l.errorRequest,
+		fields:             l.fields,
+		parent:             l.root(),
+		name:               l.name,
+		severityVar:        l.severityVar,
+		severityOverridden: l.severityOverridden,
+	}
+}
+
+// DefaultKV logs a message with key/value pairs at DEFAULT severity
+func (l *ContextLogger) DefaultKV(msg string, keysAndValues ...interface{}) {
+	l.writeKV(SeverityDefault, msg, keysAndValues)
+}
+
+// DebugKV logs a message with key/value pairs at DEBUG severity
+func (l *ContextLogger) DebugKV(msg string, keysAndValues ...interface{}) {
+	l.writeKV(SeverityDebug, msg, keysAndValues)
+}
+
+// InfoKV logs a message with key/value pairs at INFO severity
+func (l *ContextLogger) InfoKV(msg string, keysAndValues ...interface{}) {
+	l.writeKV(SeverityInfo, msg, keysAndValues)
+}
+
+// NoticeKV logs a message with key/value pairs at NOTICE severity
+func (l *ContextLogger) NoticeKV(msg string, keysAndValues ...interface{}) {
+	l.writeKV(SeverityNotice, msg, keysAndValues)
+}
+
+// WarningKV logs a message with key/value pairs at WARNING severity
+func (l *ContextLogger) WarningKV(msg string, keysAndValues ...interface{}) {
+	l.writeKV(SeverityWarning, msg, keysAndValues)
+}
+
+// WarnKV logs a message with key/value pairs at WARNING severity
+func (l *ContextLogger) WarnKV(msg string, keysAndValues ...interface{}) {
+	l.writeKV(SeverityWarning, msg, keysAndValues)
+}
+
+// ErrorKV logs a message with key/value pairs at ERROR severity
+func (l *ContextLogger) ErrorKV(msg string, keysAndValues ...interface{}) {
+	l.writeKV(SeverityError, msg, keysAndValues)
+}
+
+// CriticalKV logs a message with key/value pairs at CRITICAL severity
+func (l *ContextLogger) CriticalKV(msg string, keysAndValues ...interface{}) {
+	l.writeKV(SeverityCritical, msg, keysAndValues)
+}
+
+// AlertKV logs a message with key/value pairs at ALERT severity
+func (l *ContextLogger) AlertKV(msg string, keysAndValues ...interface{}) {
+	l.writeKV(SeverityAlert, msg, keysAndValues)
+}
+
+// EmergencyKV logs a message with key/value pairs at EMERGENCY severity
+func (l *ContextLogger) EmergencyKV(msg string, keysAndValues ...interface{}) {
+	l.writeKV(SeverityEmergency, msg, keysAndValues)
+}
+
+func (l *ContextLogger) writeKV(severity Severity, msg string, keysAndValues []interface{}) error {
+	if !l.enabled(severity) {
+		return nil
+	}
+
+	// skip frames of this function and the logging method
+	return l.writeEntry(severity, msg, fieldsFromKeysAndValues(keysAndValues), callerLocation(2), time.Now(), nil)
+}
+
+// fieldsFromKeysAndValues converts alternating keys and values to fields.
+// A key which is not a string is converted with fmt.Sprint, and a value without a key is stored as "!BADKEY".
+func fieldsFromKeysAndValues(keysAndValues []interface{}) Fields {
+	fields := make(Fields, len(keysAndValues)/2)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		if i+1 >= len(keysAndValues) {
+			fields[badKey] = fieldValue(keysAndValues[i])
+			break
+		}
+		key, ok := keysAndValues[i].(string)
+		if !ok {
+			key = fmt.Sprint(keysAndValues[i])
+		}
+		fields[key] = fieldValue(keysAndValues[i+1])
+	}
+	return fields
+}
+
+// fieldValue converts values which are not meaningful in JSON to readable ones.
+func fieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return v
+}
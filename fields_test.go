@@ -0,0 +1,98 @@
+package stackdriverlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestKeyValueFields(t *testing.T) {
+	out := new(bytes.Buffer)
+	logger := &ContextLogger{
+		sink:     NewWriterSink(out),
+		Trace:    "projects/test/traces/4bf92f3577b34da6a3ce929d0e0e4736",
+		Severity: SeverityInfo,
+	}
+
+	logger.DebugKV("skipped", "user_id", 1)
+	logger.InfoKV("hello",
+		"user_id", 123,
+		"order", map[string]interface{}{"id": "o-1", "amount": 100},
+		"err", errors.New("boom"),
+		"elapsed", 1500*time.Millisecond,
+		"message", "collision",
+		"logging.googleapis.com/trace", "collision",
+		"dangling",
+	)
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"time", "logging.googleapis.com/sourceLocation"} {
+		delete(entry, k)
+	}
+	expected := map[string]interface{}{
+		"logging.googleapis.com/trace":        "projects/test/traces/4bf92f3577b34da6a3ce929d0e0e4736",
+		"severity":                            "INFO",
+		"message":                             "hello",
+		"user_id":                             123.0,
+		"order":                               map[string]interface{}{"id": "o-1", "amount": 100.0},
+		"err":                                 "boom",
+		"elapsed":                             "1.5s",
+		"fields.message":                      "collision",
+		"fields.logging.googleapis.com/trace": "collision",
+		"!BADKEY":                             "dangling",
+	}
+	if !cmp.Equal(entry, expected) {
+		t.Errorf("diff: %s", cmp.Diff(entry, expected))
+	}
+}
+
+func TestWith(t *testing.T) {
+	out := new(bytes.Buffer)
+	parent := &ContextLogger{
+		sink:           NewWriterSink(out),
+		Severity:       SeverityInfo,
+		AdditionalData: AdditionalData{"service": "foo"},
+	}
+
+	child := parent.With(Fields{"user": "alice"})
+	grandchild := child.With(Fields{"tenant": "t1"})
+	grandchild.ErrorKV("failed", "user", "bob")
+	child.Infof("hello")
+	parent.Infof("parent")
+
+	expected := []map[string]interface{}{
+		{"message": "failed", "user": "bob", "tenant": "t1"},
+		{"message": "hello", "user": "alice"},
+		{"message": "parent"},
+	}
+	for idx, line := range bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n")) {
+		var entry map[string]interface{}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"time", "logging.googleapis.com/trace", "logging.googleapis.com/sourceLocation", "severity"} {
+			delete(entry, k)
+		}
+		if !cmp.Equal(entry["data"], map[string]interface{}{"service": "foo"}) {
+			t.Errorf("unexpected data: %v", entry["data"])
+		}
+		delete(entry, "data")
+		if !cmp.Equal(entry, expected[idx]) {
+			t.Errorf("diff: %s", cmp.Diff(entry, expected[idx]))
+		}
+	}
+
+	if len(parent.AdditionalData) != 1 {
+		t.Errorf("parent's additional data is mutated: %v", parent.AdditionalData)
+	}
+	if s := parent.maxSeverity(); s != SeverityError {
+		t.Errorf("child's log is not counted for the parent's max severity: %s", s)
+	}
+}
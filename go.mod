@@ -1,9 +1,18 @@
 module github.com/yfuruyama/stackdriver-request-context-log
 
-go 1.14
+go 1.21
 
 require (
 	github.com/go-chi/chi v4.0.3+incompatible
-	github.com/google/go-cmp v0.3.0
+	github.com/google/go-cmp v0.6.0
 	go.opencensus.io v0.22.3
+	go.opentelemetry.io/otel v1.28.0
+	go.opentelemetry.io/otel/trace v1.28.0
+)
+
+require (
+	github.com/go-logr/logr v1.4.2 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/golang/groupcache v0.0.0-20190702054246-869f871628b6 // indirect
+	go.opentelemetry.io/otel/metric v1.28.0 // indirect
 )
@@ -0,0 +1,219 @@
+package stackdriverlog
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServerIpSource is the source of the server IP in the request log.
+type ServerIpSource int
+
+const (
+	// ServerIpFromInterfaces resolves the server IP from the network interfaces of the host.
+	// The result is cached, see `Config.ServerIpRefreshInterval`.
+	ServerIpFromInterfaces ServerIpSource = iota
+
+	// ServerIpFromLocalAddr uses the local address of the connection which accepted the request.
+	ServerIpFromLocalAddr
+
+	// ServerIpDisabled doesn't log the server IP.
+	ServerIpDisabled
+)
+
+// getRemoteIp returns the IP address of the client.
+// Forwarding headers are read only when the request comes through trusted proxies.
+func getRemoteIp(r *http.Request, config *Config) string {
+	peer, ok := parseAddr(r.RemoteAddr)
+	if !ok {
+		return r.RemoteAddr
+	}
+	if config.TrustedProxyHops <= 0 && len(config.TrustedProxies) == 0 {
+		return peer.String()
+	}
+
+	// the chain of addresses from the client to the peer
+	chain, ok := forwardedChain(r.Header, config.ForwardedHeader)
+	if !ok {
+		return peer.String()
+	}
+	chain = append(chain, peer)
+
+	if config.TrustedProxyHops > 0 {
+		idx := len(chain) - 1 - config.TrustedProxyHops
+		if idx < 0 {
+			idx = 0
+		}
+		// an invalid address can't be used, so use the nearest valid one
+		for !chain[idx].IsValid() {
+			idx++
+		}
+		return chain[idx].String()
+	}
+
+	// walk from the peer, skipping trusted proxies
+	for i := len(chain) - 1; i >= 0; i-- {
+		if !chain[i].IsValid() {
+			// the address was added by an untrusted hop, so the previous one is the best known
+			return chain[i+1].String()
+		}
+		if i == 0 || !isTrustedProxy(chain[i], config.TrustedProxies) {
+			return chain[i].String()
+		}
+	}
+	return peer.String()
+}
+
+// forwardedChain returns the addresses in the forwarding header, from the client to the nearest proxy.
+// Only the header written by the proxies is read, since the others may be spoofed by the client.
+// Unparsable addresses are returned as invalid addresses.
+func forwardedChain(header http.Header, name string) ([]netip.Addr, bool) {
+	switch http.CanonicalHeaderKey(name) {
+	case "", "X-Forwarded-For":
+		if values := header.Values("X-Forwarded-For"); len(values) > 0 {
+			var chain []netip.Addr
+			for _, v := range splitHeaderValues(values) {
+				addr, _ := parseAddr(v)
+				chain = append(chain, addr)
+			}
+			return chain, true
+		}
+	case "Forwarded":
+		if values := header.Values("Forwarded"); len(values) > 0 {
+			var chain []netip.Addr
+			for _, elem := range splitHeaderValues(values) {
+				addr, _ := parseForwardedFor(elem)
+				chain = append(chain, addr)
+			}
+			return chain, true
+		}
+	case "X-Real-Ip":
+		if v := header.Get("X-Real-IP"); v != "" {
+			addr, _ := parseAddr(v)
+			return []netip.Addr{addr}, true
+		}
+	}
+	return nil, false
+}
+
+// splitHeaderValues splits comma separated values of all header lines.
+func splitHeaderValues(values []string) []string {
+	var result []string
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			result = append(result, strings.TrimSpace(elem))
+		}
+	}
+	return result
+}
+
+// parseForwardedFor parses the `for` parameter of a Forwarded header element.
+// e.g. for=192.0.2.60;proto=http;by=203.0.113.43
+func parseForwardedFor(elem string) (netip.Addr, bool) {
+	for _, pair := range strings.Split(elem, ";") {
+		k, v, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found || !strings.EqualFold(k, "for") {
+			continue
+		}
+		// obfuscated identifiers ("unknown", "_hidden") are not parsed as addresses
+		return parseAddr(strings.Trim(v, `"`))
+	}
+	return netip.Addr{}, false
+}
+
+// parseAddr parses an IP address with an optional port, e.g. "192.0.2.1", "192.0.2.1:80", "[::1]:80", "::1".
+func parseAddr(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
+
+func isTrustedProxy(addr netip.Addr, trusted []netip.Prefix) bool {
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// serverIpResolver resolves the server IP for the request log.
+type serverIpResolver struct {
+	config *Config
+
+	mu         sync.Mutex
+	cached     string
+	resolvedAt time.Time
+}
+
+func newServerIpResolver(config *Config) *serverIpResolver {
+	return &serverIpResolver{config: config}
+}
+
+func (s *serverIpResolver) resolve(r *http.Request) string {
+	if s.config.ServerIp != "" {
+		return s.config.ServerIp
+	}
+
+	switch s.config.ServerIpSource {
+	case ServerIpFromLocalAddr:
+		if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			if ip, ok := parseAddr(addr.String()); ok {
+				return ip.String()
+			}
+		}
+		return ""
+	case ServerIpDisabled:
+		return ""
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.resolvedAt.IsZero() || (s.config.ServerIpRefreshInterval > 0 && time.Since(s.resolvedAt) >= s.config.ServerIpRefreshInterval) {
+		s.cached = interfaceIp()
+		s.resolvedAt = time.Now()
+	}
+	return s.cached
+}
+
+// interfaceIp returns the first non-loopback IPv4 address of the network interfaces,
+// or the first global unicast IPv6 address if there is no IPv4 address.
+func interfaceIp() string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	var ipv6 string
+	for _, i := range ifaces {
+		if i.Flags&net.FlagUp == 0 || i.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.IsLoopback() {
+				continue
+			}
+			if ipnet.IP.To4() != nil {
+				return ipnet.IP.String()
+			}
+			if ipv6 == "" && ipnet.IP.IsGlobalUnicast() {
+				ipv6 = ipnet.IP.String()
+			}
+		}
+	}
+	return ipv6
+}
@@ -0,0 +1,145 @@
+package stackdriverlog
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+)
+
+func TestGetRemoteIp(t *testing.T) {
+	trusted := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     map[string]string
+		proxies    []netip.Prefix
+		hops       int
+		forwarded  string // ForwardedHeader
+		expected   string
+	}{
+		{"ipv4", "192.0.2.1:1234", nil, nil, 0, "", "192.0.2.1"},
+		{"ipv6", "[::1]:61352", nil, nil, 0, "", "::1"},
+		{"ipv6 with zone", "[fe80::1%eth0]:80", nil, nil, 0, "", "fe80::1"},
+		{"ipv4-mapped ipv6", "[::ffff:192.0.2.1]:80", nil, nil, 0, "", "192.0.2.1"},
+		{"no port", "192.0.2.1", nil, nil, 0, "", "192.0.2.1"},
+		{"unparsable", "@", nil, nil, 0, "", "@"},
+		{
+			"headers are ignored without trusted proxies",
+			"192.0.2.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, nil, 0, "", "192.0.2.1",
+		},
+		{
+			"x-forwarded-for from trusted proxy",
+			"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1, 10.0.0.2"}, trusted, 0, "", "198.51.100.1",
+		},
+		{
+			"spoofed x-forwarded-for from untrusted peer",
+			"192.0.2.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, trusted, 0, "", "192.0.2.1",
+		},
+		{
+			"spoofed x-forwarded-for prepended by client",
+			"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.3, 198.51.100.1"}, trusted, 0, "", "198.51.100.1",
+		},
+		{
+			"garbage x-forwarded-for",
+			"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1, garbage"}, trusted, 0, "", "10.0.0.1",
+		},
+		{
+			"all addresses are trusted",
+			"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, trusted, 0, "", "10.0.0.3",
+		},
+		{
+			"forwarded",
+			"[2001:db8::1]:1234", map[string]string{"Forwarded": `for="[2001:db8:cafe::17]:4711";proto=https, for=10.0.0.2`}, trusted, 0, "Forwarded", "2001:db8:cafe::17",
+		},
+		{
+			"spoofed forwarded is ignored with trusted proxies",
+			"10.0.0.1:1234", map[string]string{"Forwarded": "for=6.6.6.6", "X-Forwarded-For": "203.0.113.7"}, trusted, 0, "", "203.0.113.7",
+		},
+		{
+			"spoofed forwarded is ignored with hops",
+			"10.0.0.1:1234", map[string]string{"Forwarded": "for=6.6.6.6", "X-Forwarded-For": "203.0.113.7"}, nil, 1, "", "203.0.113.7",
+		},
+		{
+			"obfuscated forwarded",
+			"10.0.0.1:1234", map[string]string{"Forwarded": "for=unknown, for=10.0.0.2"}, trusted, 0, "Forwarded", "10.0.0.2",
+		},
+		{
+			"x-real-ip",
+			"10.0.0.1:1234", map[string]string{"X-Real-IP": "198.51.100.1"}, trusted, 0, "X-Real-IP", "198.51.100.1",
+		},
+		{
+			"x-real-ip is ignored by default",
+			"10.0.0.1:1234", map[string]string{"X-Real-IP": "198.51.100.1"}, trusted, 0, "", "10.0.0.1",
+		},
+		{
+			"hops",
+			"192.0.2.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.9, 198.51.100.1"}, nil, 1, "", "198.51.100.1",
+		},
+		{
+			"hops with spoofed x-forwarded-for",
+			"192.0.2.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.9, 198.51.100.8, 198.51.100.1, 192.0.2.2"}, nil, 2, "", "198.51.100.1",
+		},
+		{
+			"hops more than forwarded addresses",
+			"192.0.2.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, nil, 3, "", "198.51.100.1",
+		},
+		{
+			"hops with garbage",
+			"192.0.2.1:1234", map[string]string{"X-Forwarded-For": "garbage"}, nil, 1, "", "192.0.2.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			config := NewConfig("test")
+			config.TrustedProxies = tt.proxies
+			config.TrustedProxyHops = tt.hops
+			config.ForwardedHeader = tt.forwarded
+			if ip := getRemoteIp(r, config); ip != tt.expected {
+				t.Errorf("got %s, want %s", ip, tt.expected)
+			}
+		})
+	}
+}
+
+func TestServerIpResolver(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 8080}))
+
+	config := NewConfig("test")
+	resolver := newServerIpResolver(config)
+
+	config.ServerIp = "192.0.2.1"
+	if ip := resolver.resolve(r); ip != "192.0.2.1" {
+		t.Errorf("static: got %s", ip)
+	}
+
+	config.ServerIp = ""
+	config.ServerIpSource = ServerIpFromLocalAddr
+	if ip := resolver.resolve(r); ip != "2001:db8::1" {
+		t.Errorf("local addr: got %s", ip)
+	}
+
+	config.ServerIpSource = ServerIpDisabled
+	if ip := resolver.resolve(r); ip != "" {
+		t.Errorf("disabled: got %s", ip)
+	}
+
+	config.ServerIpSource = ServerIpFromInterfaces
+	ip := resolver.resolve(r)
+	resolvedAt := resolver.resolvedAt
+	if resolver.resolve(r) != ip || resolver.resolvedAt != resolvedAt {
+		t.Errorf("server ip is not cached")
+	}
+}
@@ -0,0 +1,144 @@
+package stackdriverlog
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LogLevelHeaderConfig is the configuration to lower the severity of context logs per request
+// with a signed request header, so that debug logs can be seen in production.
+//
+// The header value is `SEVERITY;TIMESTAMP;SIGNATURE`, where TIMESTAMP is the unix time in seconds and
+// SIGNATURE is the hex-encoded HMAC-SHA256 of `SEVERITY;TIMESTAMP` with Secret. Use `SignLogLevel` to create it.
+type LogLevelHeaderConfig struct {
+	// Header is the name of the header. The default is "X-Log-Level".
+	Header string
+
+	// Secret is the key of HMAC-SHA256.
+	Secret []byte
+
+	// MaxAge is how long the signed header is valid. The default is 5 minutes.
+	MaxAge time.Duration
+}
+
+// LogLevelOverride is recorded in the request log when the request has the log level header.
+type LogLevelOverride struct {
+	// Severity is the requested severity, which is empty if it's unknown
+	Severity string `json:"severity,omitempty"`
+	Applied  bool   `json:"applied"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// String returns the severity and whether it's applied, e.g. "DEBUG (applied)", "DEBUG (ignored: expired)".
+func (o *LogLevelOverride) String() string {
+	if o.Applied {
+		return o.Severity + " (applied)"
+	}
+	if o.Severity == "" {
+		return "(ignored: " + o.Reason + ")"
+	}
+	return fmt.Sprintf("%s (ignored: %s)", o.Severity, o.Reason)
+}
+
+const (
+	defaultLogLevelHeader = "X-Log-Level"
+	defaultLogLevelMaxAge = 5 * time.Minute
+)
+
+// ParseSeverity parses the text representation of the severity, e.g. "DEBUG".
+func ParseSeverity(s string) (Severity, error) {
+	for _, severity := range []Severity{
+		SeverityDefault,
+		SeverityDebug,
+		SeverityInfo,
+		SeverityNotice,
+		SeverityWarning,
+		SeverityError,
+		SeverityCritical,
+		SeverityAlert,
+		SeverityEmergency,
+	} {
+		if strings.EqualFold(s, severity.String()) {
+			return severity, nil
+		}
+	}
+	return SeverityDefault, fmt.Errorf("unknown severity: %q", s)
+}
+
+// SignLogLevel creates the value of the log level header.
+func SignLogLevel(secret []byte, severity Severity, t time.Time) string {
+	payload := fmt.Sprintf("%s;%d", severity, t.Unix())
+	return payload + ";" + logLevelSignature(secret, payload)
+}
+
+func logLevelSignature(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// logLevelOverride verifies the log level header of the request.
+// It returns nil if the request doesn't have the header.
+func (c *LogLevelHeaderConfig) logLevelOverride(r *http.Request, current Severity, now time.Time) (*LogLevelOverride, Severity) {
+	header := c.Header
+	if header == "" {
+		header = defaultLogLevelHeader
+	}
+	value := r.Header.Get(header)
+	if value == "" {
+		return nil, current
+	}
+
+	parts := strings.Split(value, ";")
+	override := &LogLevelOverride{}
+	// the header is arbitrary input, so only a known severity is recorded
+	severity, err := ParseSeverity(parts[0])
+	if err == nil {
+		override.Severity = severity.String()
+	}
+	if len(parts) != 3 {
+		override.Reason = "invalid format"
+		return override, current
+	}
+	if err != nil {
+		override.Reason = "unknown severity"
+		return override, current
+	}
+
+	if len(c.Secret) == 0 {
+		override.Reason = "no secret is configured"
+		return override, current
+	}
+	expected := logLevelSignature(c.Secret, parts[0]+";"+parts[1])
+	if !hmac.Equal([]byte(parts[2]), []byte(expected)) {
+		override.Reason = "invalid signature"
+		return override, current
+	}
+
+	timestamp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		override.Reason = "invalid format"
+		return override, current
+	}
+	maxAge := c.MaxAge
+	if maxAge <= 0 {
+		maxAge = defaultLogLevelMaxAge
+	}
+	if age := now.Sub(time.Unix(timestamp, 0)); age > maxAge || age < -maxAge {
+		override.Reason = "expired"
+		return override, current
+	}
+
+	if severity >= current {
+		override.Reason = "not lower than the current severity"
+		return override, current
+	}
+	override.Applied = true
+	return override, severity
+}
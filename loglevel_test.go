@@ -0,0 +1,181 @@
+package stackdriverlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLogLevelOverride(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Unix(1700000000, 0)
+	config := &LogLevelHeaderConfig{Secret: secret}
+
+	tests := []struct {
+		name             string
+		header           string
+		expected         *LogLevelOverride
+		expectedSeverity Severity
+	}{
+		{
+			"no header",
+			"",
+			nil,
+			SeverityInfo,
+		},
+		{
+			"valid",
+			SignLogLevel(secret, SeverityDebug, now),
+			&LogLevelOverride{Severity: "DEBUG", Applied: true},
+			SeverityDebug,
+		},
+		{
+			"invalid signature",
+			SignLogLevel([]byte("wrong"), SeverityDebug, now),
+			&LogLevelOverride{Severity: "DEBUG", Reason: "invalid signature"},
+			SeverityInfo,
+		},
+		{
+			"tampered severity",
+			"DEFAULT" + strings.TrimPrefix(SignLogLevel(secret, SeverityDebug, now), "DEBUG"),
+			&LogLevelOverride{Severity: "DEFAULT", Reason: "invalid signature"},
+			SeverityInfo,
+		},
+		{
+			"expired",
+			SignLogLevel(secret, SeverityDebug, now.Add(-10*time.Minute)),
+			&LogLevelOverride{Severity: "DEBUG", Reason: "expired"},
+			SeverityInfo,
+		},
+		{
+			"not lower",
+			SignLogLevel(secret, SeverityError, now),
+			&LogLevelOverride{Severity: "ERROR", Reason: "not lower than the current severity"},
+			SeverityInfo,
+		},
+		{
+			"unsigned",
+			"DEBUG",
+			&LogLevelOverride{Severity: "DEBUG", Reason: "invalid format"},
+			SeverityInfo,
+		},
+		{
+			"unknown severity",
+			"VERBOSE;1700000000;00",
+			&LogLevelOverride{Reason: "unknown severity"},
+			SeverityInfo,
+		},
+		{
+			"long invalid header",
+			strings.Repeat("x", 10000),
+			&LogLevelOverride{Reason: "invalid format"},
+			SeverityInfo,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Log-Level", tt.header)
+			}
+			override, severity := config.logLevelOverride(r, SeverityInfo, now)
+			if !cmp.Equal(override, tt.expected) {
+				t.Errorf("diff: %s", cmp.Diff(override, tt.expected))
+			}
+			if severity != tt.expectedSeverity {
+				t.Errorf("unexpected severity: got %s, want %s", severity, tt.expectedSeverity)
+			}
+		})
+	}
+}
+
+func TestLogLevelHeader(t *testing.T) {
+	secret := []byte("secret")
+	r, _ := http.NewRequest("GET", "/foo", nil)
+	r.Header.Set("X-Log-Level", SignLogLevel(secret, SeverityDebug, time.Now()))
+	w := httptest.NewRecorder()
+
+	requestLogOut := new(bytes.Buffer)
+	contextLogOut := new(bytes.Buffer)
+
+	config := NewConfig("test")
+	config.RequestLogOut = requestLogOut
+	config.ContextLogOut = contextLogOut
+	config.Severity = SeverityInfo
+	config.LogLevelHeader = &LogLevelHeaderConfig{Secret: secret}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/foo", func(w http.ResponseWriter, r *http.Request) {
+		logger := RequestContextLogger(r)
+		logger.Debug("debug")
+	})
+	handler := RequestLogging(config)(mux)
+	handler.ServeHTTP(w, r)
+
+	if !strings.Contains(contextLogOut.String(), `"message":"debug"`) {
+		t.Errorf("debug log is not written: %s", contextLogOut.String())
+	}
+
+	var httpRequestLog HttpRequestLog
+	if err := json.Unmarshal(requestLogOut.Bytes(), &httpRequestLog); err != nil {
+		t.Fatal(err)
+	}
+	expected := &LogLevelOverride{Severity: "DEBUG", Applied: true}
+	if !cmp.Equal(httpRequestLog.LogLevelOverride, expected) {
+		t.Errorf("diff: %s", cmp.Diff(httpRequestLog.LogLevelOverride, expected))
+	}
+}
+
+func TestLogLevelHeaderIsAlwaysLogged(t *testing.T) {
+	secret := []byte("secret")
+	tests := []struct {
+		name  string
+		apply func(config *Config)
+	}{
+		{"excluded", func(config *Config) { config.Exclude = []RequestFilter{PathPrefix("/foo")} }},
+		{"sampled out", func(config *Config) { config.Sampler = NewSampler(SamplingRule{Drop: true}) }},
+		{"buffer discarded", func(config *Config) { config.Buffer = &BufferConfig{Fallback: BufferDiscard} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/foo", nil)
+			r.Header.Set("X-Log-Level", SignLogLevel(secret, SeverityDebug, time.Now()))
+
+			requestLogOut := new(bytes.Buffer)
+			contextLogOut := new(bytes.Buffer)
+			config := NewConfig("test")
+			config.RequestLogOut = requestLogOut
+			config.ContextLogOut = contextLogOut
+			config.LogLevelHeader = &LogLevelHeaderConfig{Secret: secret}
+			tt.apply(config)
+
+			handler := RequestLogging(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				RequestContextLogger(r).Debug("debug")
+			}))
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+
+			if !strings.Contains(contextLogOut.String(), `"message":"debug"`) {
+				t.Errorf("debug log is not written: %s", contextLogOut.String())
+			}
+			if !strings.Contains(requestLogOut.String(), `"logLevelOverride":{"severity":"DEBUG","applied":true}`) {
+				t.Errorf("request log is not written for audit: %s", requestLogOut.String())
+			}
+		})
+	}
+}
+
+func TestParseSeverity(t *testing.T) {
+	if s, err := ParseSeverity("warning"); err != nil || s != SeverityWarning {
+		t.Errorf("unexpected result: %s, %v", s, err)
+	}
+	if _, err := ParseSeverity("VERBOSE"); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -2,98 +2,293 @@ package stackdriverlog
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/rand"
 	"fmt"
-	"net"
+	"io"
 	"net/http"
 	"os"
+	"runtime"
+	"runtime/debug"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"go.opencensus.io/exporter/stackdriver/propagation"
-	"go.opencensus.io/trace"
+	octrace "go.opencensus.io/trace"
+	"go.opentelemetry.io/otel"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+const (
+	packagePath = "github.com/yfuruyama/stackdriver-request-context-log"
+	tracerName  = packagePath
 )
 
 // RequestLogging creates the middleware which logs a request log and creates a request-context logger
 func RequestLogging(config *Config) func(http.Handler) http.Handler {
+	serverIp := newServerIpResolver(config)
+	requestLogSink, contextLogSink := config.sinks()
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
 			before := time.Now()
+			// evaluated before the handler since routers may rewrite the request
+			excluded := isExcluded(r, config.Exclude)
 
-			traceId := getTraceId(r)
-			if traceId == "" {
-				// there is no span yet, so create one
+			sc, ok := getSpanContext(r, config)
+			if !ok {
+				// there is no span yet, so create one as a child of the incoming trace if any
+				remote, hasRemote := getRemoteSpanContext(r, config)
 				var ctx context.Context
-				traceId, ctx = generateTraceId(r)
+				var endSpan func()
+				sc, ctx, endSpan = generateSpanContext(r, config, remote, hasRemote)
+				defer endSpan()
 				r = r.WithContext(ctx)
 			}
 
-			trace := fmt.Sprintf("projects/%s/traces/%s", config.ProjectId, traceId)
+			trace := fmt.Sprintf("projects/%s/traces/%s", config.ProjectId, sc.TraceId)
 
 			contextLogger := &ContextLogger{
-				out:            config.ContextLogOut,
+				sink:           contextLogSink,
 				Trace:          trace,
-				Severity:       config.Severity,
+				SpanId:         sc.SpanId,
+				TraceSampled:   sc.Sampled,
+				Severity:       config.severity(),
 				AdditionalData: config.AdditionalData,
-				loggedSeverity: make([]Severity, 0, 10),
+				serviceContext: config.ServiceContext,
+				reportErrors:   config.ReportErrors,
+				errorRequest:   newErrorHttpRequest(r, config),
+				severityVar:    config.SeverityVar,
+			}
+			var logLevelOverride *LogLevelOverride
+			if config.LogLevelHeader != nil {
+				logLevelOverride, contextLogger.Severity = config.LogLevelHeader.logLevelOverride(r, contextLogger.Severity, before)
+				contextLogger.severityOverridden = logLevelOverride != nil && logLevelOverride.Applied
+			}
+			// requests with the applied log level header are always logged for audit,
+			// together with the context logs which the header enabled
+			forceLog := contextLogger.severityOverridden
+			if config.Buffer != nil {
+				contextLogger.startBuffering(config.Buffer, true)
+			} else if config.Sampler != nil && !excluded && !forceLog && config.Sampler.mayDrop(r) {
+				// the sampler decides at the end of the request, so hold context logs until then
+				contextLogger.startBuffering(samplingBuffer, false)
+			}
+			r = r.WithContext(NewContext(r.Context(), contextLogger))
+
+			body := &countingReadCloser{ReadCloser: r.Body}
+			if r.Body != nil {
+				r.Body = body
 			}
-			ctx := context.WithValue(r.Context(), contextLoggerKey, contextLogger)
-			r = r.WithContext(ctx)
 
 			wrw := &wrappedResponseWriter{ResponseWriter: w}
 			defer func() {
+				status := wrw.status
+				var recovered interface{}
+				if config.RecoverPanic {
+					recovered = recover()
+					// ErrAbortHandler is used to abort the response intentionally, so it's not logged as a panic
+					if recovered != nil && recovered != http.ErrAbortHandler {
+						// the message has the stack trace, so it's also reported to Error Reporting
+						contextLogger.writeEntry(SeverityCritical, panicMessage(recovered), nil, panicLocation(), time.Now(), &errorReport{})
+						if wrw.status == 0 {
+							http.Error(wrw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+						}
+						status = http.StatusInternalServerError
+					}
+				}
+
 				// logging
 				elapsed := time.Since(before)
-				maxSeverity := contextLogger.maxSeverity()
-				err := writeRequestLog(r, config, wrw.status, wrw.responseSize, elapsed, trace, maxSeverity)
-				if err != nil {
+				// excluded and forcibly logged requests are not counted by the sampler
+				sampled := excluded || forceLog || config.Sampler == nil || config.Sampler.sample(r, status, elapsed, sc.TraceId)
+				// discarded logs also count for the severity of the request log
+				maxSeverity := max(contextLogger.maxSeverity(), contextLogger.bufferedMaxSeverity())
+				// logs held only for the sampler are already filtered by severity
+				action := bufferWriteAll
+				if config.Buffer != nil {
+					action = config.Buffer.Fallback
+					if config.Buffer.shouldFlushAll(maxSeverity, status, elapsed) {
+						action = bufferWriteAll
+					} else if forceLog {
+						// logs at or above the severity lowered by the header
+						action = BufferWriteAboveSeverity
+					}
+				}
+				if !sampled {
+					action = BufferDiscard
+				}
+				if err := contextLogger.flushBuffer(action); err != nil {
 					fmt.Fprintln(os.Stderr, err.Error())
 				}
+				if forceLog || (sampled && !excluded) {
+					requestSize := requestHeaderSize(r) + max(body.n.Load(), r.ContentLength)
+					err := writeRequestLog(requestLogSink, r, config, requestSize, status, wrw.responseSize.Load(), elapsed, trace, sc, maxSeverity, serverIp.resolve(r), logLevelOverride)
+					if err != nil {
+						fmt.Fprintln(os.Stderr, err.Error())
+					}
+				} else if flusher, ok := contextLogSink.(traceFlusher); ok {
+					// context logs don't need to wait for the request log which is never written
+					if err := flusher.flushTrace(trace); err != nil {
+						fmt.Fprintln(os.Stderr, err.Error())
+					}
+				}
+
+				if recovered != nil && (config.Repanic || recovered == http.ErrAbortHandler) {
+					panic(recovered)
+				}
 			}()
-			next.ServeHTTP(wrw, r)
+			next.ServeHTTP(wrw.wrap(), r)
 		}
 		return http.HandlerFunc(fn)
 	}
 }
 
-func getTraceId(r *http.Request) string {
-	span := trace.FromContext(r.Context())
-	if span != nil {
-		return span.SpanContext().TraceID.String()
+// panicMessage formats the recovered value with the stack trace of the panicking goroutine.
+func panicMessage(recovered interface{}) string {
+	return fmt.Sprintf("panic: %v\n\n%s", recovered, debug.Stack())
+}
+
+// panicLocation returns the source location where the panic occurred.
+// It must be called from the deferred function which recovered the panic.
+func panicLocation() SourceLocation {
+	pcs := make([]uintptr, 32)
+	n := runtime.Callers(2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		if frame.Function == "runtime.gopanic" {
+			if frame, _ := frames.Next(); frame.Function != "" {
+				return newSourceLocation(frame.Function, frame.File, frame.Line)
+			}
+		}
+		if !more {
+			break
+		}
+	}
+	return SourceLocation{}
+}
+
+// getSpanContext returns the span which is already started for the request, e.g. by otelhttp.
+func getSpanContext(r *http.Request, config *Config) (SpanContext, bool) {
+	if sc := oteltrace.SpanContextFromContext(r.Context()); sc.IsValid() {
+		return fromOpenTelemetrySpanContext(sc), true
 	}
 
-	httpFormat := &propagation.HTTPFormat{}
-	if sc, ok := httpFormat.SpanContextFromRequest(r); ok {
-		return sc.TraceID.String()
+	if config.OpenCensusCompatible {
+		if span := octrace.FromContext(r.Context()); span != nil {
+			return fromOpenCensusSpanContext(span.SpanContext()), true
+		}
 	}
+	return SpanContext{}, false
+}
 
-	return ""
+// getRemoteSpanContext extracts the span of the caller from the request headers.
+func getRemoteSpanContext(r *http.Request, config *Config) (SpanContext, bool) {
+	propagators := config.Propagators
+	if propagators == nil {
+		propagators = DefaultPropagators()
+	}
+	return extractSpanContext(r, propagators)
 }
 
-func generateTraceId(r *http.Request) (string, context.Context) {
-	ctx, span := trace.StartSpan(r.Context(), "")
+// generateSpanContext starts a new server span for the request, as a child of the remote span if hasRemote is true.
+// The returned function must be called to end the span.
+func generateSpanContext(r *http.Request, config *Config, remote SpanContext, hasRemote bool) (SpanContext, context.Context, func()) {
+	if config.OpenCensusCompatible {
+		var ctx context.Context
+		var span *octrace.Span
+		if parent, ok := toOpenCensusSpanContext(remote); hasRemote && ok {
+			ctx, span = octrace.StartSpanWithRemoteParent(r.Context(), r.Method, parent, octrace.WithSpanKind(octrace.SpanKindServer))
+		} else {
+			ctx, span = octrace.StartSpan(r.Context(), r.Method, octrace.WithSpanKind(octrace.SpanKindServer))
+		}
+		return fromOpenCensusSpanContext(span.SpanContext()), ctx, span.End
+	}
+
+	ctx := r.Context()
+	var parent oteltrace.SpanContext
+	if hasRemote {
+		parent = toOpenTelemetrySpanContext(remote)
+		ctx = oteltrace.ContextWithRemoteSpanContext(ctx, parent)
+	}
+
+	tp := config.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	ctx, span := tp.Tracer(tracerName).Start(ctx, r.Method, oteltrace.WithSpanKind(oteltrace.SpanKindServer))
 	sc := span.SpanContext()
-	return sc.TraceID.String(), ctx
+	if hasRemote && (!sc.IsValid() || sc.SpanID() == parent.SpanID()) {
+		// the tracer provider doesn't record spans (e.g. no-op provider), so log the remote span as it is
+		return remote, ctx, func() { span.End() }
+	}
+	if !sc.IsValid() {
+		// generate ids by ourselves to keep logs grouped
+		sc = randomSpanContext()
+		ctx = oteltrace.ContextWithSpanContext(ctx, sc)
+	}
+	return fromOpenTelemetrySpanContext(sc), ctx, func() { span.End() }
+}
+
+// toOpenTelemetrySpanContext converts the remote span. If the span ID is missing (e.g. X-Cloud-Trace-Context
+// without span), a random one is used so that child spans still belong to the trace.
+func toOpenTelemetrySpanContext(sc SpanContext) oteltrace.SpanContext {
+	traceId, _ := oteltrace.TraceIDFromHex(sc.TraceId)
+	spanId, err := oteltrace.SpanIDFromHex(sc.SpanId)
+	if err != nil || !spanId.IsValid() {
+		rand.Read(spanId[:])
+	}
+	var flags oteltrace.TraceFlags
+	if sc.Sampled {
+		flags = oteltrace.FlagsSampled
+	}
+	return oteltrace.NewSpanContext(oteltrace.SpanContextConfig{
+		TraceID:    traceId,
+		SpanID:     spanId,
+		TraceFlags: flags,
+		Remote:     true,
+	})
 }
 
-type wrappedResponseWriter struct {
-	http.ResponseWriter
-	status       int
-	responseSize int
+func toOpenCensusSpanContext(sc SpanContext) (octrace.SpanContext, bool) {
+	otelSc := toOpenTelemetrySpanContext(sc)
+	if !otelSc.IsValid() {
+		return octrace.SpanContext{}, false
+	}
+	parent := octrace.SpanContext{
+		TraceID: octrace.TraceID(otelSc.TraceID()),
+		SpanID:  octrace.SpanID(otelSc.SpanID()),
+	}
+	if sc.Sampled {
+		parent.TraceOptions = 1
+	}
+	return parent, true
 }
 
-func (w *wrappedResponseWriter) WriteHeader(status int) {
-	w.status = status
-	w.ResponseWriter.WriteHeader(status)
+func randomSpanContext() oteltrace.SpanContext {
+	var traceId oteltrace.TraceID
+	var spanId oteltrace.SpanID
+	rand.Read(traceId[:])
+	rand.Read(spanId[:])
+	return oteltrace.NewSpanContext(oteltrace.SpanContextConfig{
+		TraceID: traceId,
+		SpanID:  spanId,
+	})
 }
 
-func (w *wrappedResponseWriter) Write(b []byte) (int, error) {
-	if w.status == 0 {
-		w.status = http.StatusOK
+func fromOpenTelemetrySpanContext(sc oteltrace.SpanContext) SpanContext {
+	return SpanContext{
+		TraceId: sc.TraceID().String(),
+		SpanId:  sc.SpanID().String(),
+		Sampled: sc.IsSampled(),
+	}
+}
+
+func fromOpenCensusSpanContext(sc octrace.SpanContext) SpanContext {
+	return SpanContext{
+		TraceId: sc.TraceID.String(),
+		SpanId:  sc.SpanID.String(),
+		Sampled: sc.IsSampled(),
 	}
-	n, err := w.ResponseWriter.Write(b)
-	w.responseSize += n
-	return n, err
 }
 
 type HttpRequest struct {
@@ -113,28 +308,43 @@ type HttpRequest struct {
 	Protocol                       string `json:"protocol"`
 }
 
+// HttpRequestLog is the JSON format of request logs written by `WriterSink`.
 type HttpRequestLog struct {
 	Time           string         `json:"time"`
 	Trace          string         `json:"logging.googleapis.com/trace"`
+	SpanId         string         `json:"logging.googleapis.com/spanId,omitempty"`
+	TraceSampled   bool           `json:"logging.googleapis.com/trace_sampled,omitempty"`
 	Severity       string         `json:"severity"`
 	HttpRequest    HttpRequest    `json:"httpRequest"`
 	AdditionalData AdditionalData `json:"data,omitempty"`
+
+	// LogLevelOverride is recorded when the request has the log level header
+	LogLevelOverride *LogLevelOverride `json:"logLevelOverride,omitempty"`
 }
 
-func writeRequestLog(r *http.Request, config *Config, status int, responseSize int, elapsed time.Duration, trace string, severity Severity) error {
-	requestLog := &HttpRequestLog{
-		Time:     time.Now().Format(time.RFC3339Nano),
-		Trace:    trace,
-		Severity: severity.String(),
-		HttpRequest: HttpRequest{
+func writeRequestLog(sink Sink, r *http.Request, config *Config, requestSize int64, status int, responseSize int64, elapsed time.Duration, trace string, sc SpanContext, severity Severity, serverIp string, logLevelOverride *LogLevelOverride) error {
+	payload := make(map[string]interface{}, 2)
+	if len(config.AdditionalData) > 0 {
+		payload["data"] = config.AdditionalData
+	}
+	if logLevelOverride != nil {
+		payload["logLevelOverride"] = logLevelOverride
+	}
+	return sink.WriteEntry(&Entry{
+		Severity:     severity,
+		Time:         time.Now(),
+		Trace:        trace,
+		SpanId:       sc.SpanId,
+		TraceSampled: sc.Sampled,
+		HttpRequest: &HttpRequest{
 			RequestMethod:                  r.Method,
 			RequestUrl:                     r.URL.RequestURI(),
-			RequestSize:                    fmt.Sprintf("%d", r.ContentLength),
+			RequestSize:                    fmt.Sprintf("%d", requestSize),
 			Status:                         status,
 			ResponseSize:                   fmt.Sprintf("%d", responseSize),
 			UserAgent:                      r.UserAgent(),
-			RemoteIp:                       getRemoteIp(r),
-			ServerIp:                       getServerIp(),
+			RemoteIp:                       getRemoteIp(r, config),
+			ServerIp:                       serverIp,
 			Referer:                        r.Referer(),
 			Latency:                        fmt.Sprintf("%fs", elapsed.Seconds()),
 			CacheLookup:                    false,
@@ -142,40 +352,44 @@ func writeRequestLog(r *http.Request, config *Config, status int, responseSize i
 			CacheValidatedWithOriginServer: false,
 			Protocol:                       r.Proto,
 		},
-		AdditionalData: config.AdditionalData,
-	}
-	requestLogJson, err := json.Marshal(requestLog)
-	if err != nil {
-		return err
-	}
-	requestLogJson = append(requestLogJson, '\n')
+		Payload: payload,
+	})
+}
 
-	_, err = config.RequestLogOut.Write(requestLogJson)
-	return err
+// countingReadCloser counts bytes read from the request body.
+type countingReadCloser struct {
+	io.ReadCloser
+	n atomic.Int64 // the body may be read by another goroutine
 }
 
-func getRemoteIp(r *http.Request) string {
-	parts := strings.Split(r.RemoteAddr, ":")
-	return parts[0]
+func (c *countingReadCloser) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	c.n.Add(int64(n))
+	return n, err
 }
 
-func getServerIp() string {
-	ifaces, err := net.Interfaces()
-	if err != nil {
-		return ""
+// requestHeaderSize estimates the size of the request line and headers in HTTP/1.1 wire format.
+func requestHeaderSize(r *http.Request) int64 {
+	uri := r.RequestURI
+	if uri == "" {
+		uri = r.URL.RequestURI()
 	}
-	for _, i := range ifaces {
-		addrs, err := i.Addrs()
-		if err != nil {
-			return ""
-		}
-		for _, addr := range addrs {
-			if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-				if ipnet.IP.To4() != nil {
-					return ipnet.IP.String()
-				}
-			}
+	// "METHOD URI PROTO\r\n"
+	size := len(r.Method) + 1 + len(uri) + 1 + len(r.Proto) + 2
+	// Host and Transfer-Encoding headers are removed from r.Header by net/http
+	if r.Host != "" {
+		size += len("Host: ") + len(r.Host) + 2
+	}
+	if len(r.TransferEncoding) > 0 {
+		size += len("Transfer-Encoding: ") + len(strings.Join(r.TransferEncoding, ", ")) + 2
+	}
+	for k, vs := range r.Header {
+		for _, v := range vs {
+			// "Key: value\r\n"
+			size += len(k) + 2 + len(v) + 2
 		}
 	}
-	return ""
+	// empty line at the end of headers
+	size += 2
+	return int64(size)
 }
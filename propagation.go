@@ -0,0 +1,207 @@
+package stackdriverlog
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// SpanContext is the trace information extracted from an incoming request.
+type SpanContext struct {
+	TraceId string // 32 lowercase hex characters
+	SpanId  string // 16 lowercase hex characters, may be empty
+	Sampled bool
+}
+
+// Propagator extracts a span context from an incoming request.
+type Propagator interface {
+	Extract(r *http.Request) (SpanContext, bool)
+}
+
+// DefaultPropagators returns the propagators used when `Config.Propagators` is not set.
+// X-Cloud-Trace-Context is tried first, then W3C Trace Context, then B3.
+func DefaultPropagators() []Propagator {
+	return []Propagator{
+		&CloudTraceContextPropagator{},
+		&TraceContextPropagator{},
+		&B3Propagator{},
+	}
+}
+
+// CloudTraceContextPropagator reads the `X-Cloud-Trace-Context` header.
+// Format: TRACE_ID/SPAN_ID;o=TRACE_TRUE
+type CloudTraceContextPropagator struct{}
+
+const cloudTraceContextHeader = "X-Cloud-Trace-Context"
+
+// Extract implements Propagator
+func (p *CloudTraceContextPropagator) Extract(r *http.Request) (SpanContext, bool) {
+	h := r.Header.Get(cloudTraceContextHeader)
+	if h == "" {
+		return SpanContext{}, false
+	}
+
+	var sc SpanContext
+	traceId := h
+	if i := strings.Index(h, "/"); i >= 0 {
+		traceId = h[:i]
+		rest := h[i+1:]
+		spanId := rest
+		if j := strings.Index(rest, ";"); j >= 0 {
+			spanId = rest[:j]
+			sc.Sampled = strings.TrimSpace(rest[j+1:]) == "o=1"
+		}
+		// span id of this header is an unsigned decimal integer
+		if id, err := strconv.ParseUint(spanId, 10, 64); err == nil && id != 0 {
+			sc.SpanId = fmt.Sprintf("%016x", id)
+		}
+	}
+	traceId = strings.ToLower(traceId)
+	if !isValidHexId(traceId, 32) {
+		return SpanContext{}, false
+	}
+	sc.TraceId = traceId
+	return sc, true
+}
+
+// TraceContextPropagator reads the W3C `traceparent` header.
+// Format: VERSION-TRACE_ID-PARENT_ID-TRACE_FLAGS
+// https://www.w3.org/TR/trace-context/
+type TraceContextPropagator struct{}
+
+const traceparentHeader = "traceparent"
+
+// Extract implements Propagator
+func (p *TraceContextPropagator) Extract(r *http.Request) (SpanContext, bool) {
+	h := strings.TrimSpace(r.Header.Get(traceparentHeader))
+	if h == "" {
+		return SpanContext{}, false
+	}
+
+	parts := strings.Split(h, "-")
+	if len(parts) < 4 {
+		return SpanContext{}, false
+	}
+	version, traceId, spanId, flags := parts[0], parts[1], parts[2], parts[3]
+	if !isHex(version, 2) || version == "ff" {
+		return SpanContext{}, false
+	}
+	// version 00 must have exactly four fields, future versions may append more
+	if version == "00" && len(parts) != 4 {
+		return SpanContext{}, false
+	}
+	if !isValidHexId(traceId, 32) || !isValidHexId(spanId, 16) || !isHex(flags, 2) {
+		return SpanContext{}, false
+	}
+	f, err := hex.DecodeString(flags)
+	if err != nil {
+		return SpanContext{}, false
+	}
+
+	return SpanContext{
+		TraceId: traceId,
+		SpanId:  spanId,
+		Sampled: f[0]&0x01 == 0x01,
+	}, true
+}
+
+// B3Propagator reads the B3 headers used by Zipkin.
+// Both the single header (`b3`) and the multiple headers (`X-B3-TraceId`, etc.) are supported,
+// the single header takes precedence.
+// https://github.com/openzipkin/b3-propagation
+type B3Propagator struct{}
+
+const (
+	b3SingleHeader  = "b3"
+	b3TraceIdHeader = "X-B3-TraceId"
+	b3SpanIdHeader  = "X-B3-SpanId"
+	b3SampledHeader = "X-B3-Sampled"
+	b3FlagsHeader   = "X-B3-Flags"
+)
+
+// Extract implements Propagator
+func (p *B3Propagator) Extract(r *http.Request) (SpanContext, bool) {
+	if h := strings.TrimSpace(r.Header.Get(b3SingleHeader)); h != "" {
+		return extractB3Single(h)
+	}
+	return extractB3Multi(r.Header)
+}
+
+func extractB3Single(h string) (SpanContext, bool) {
+	// b3: {TraceId}-{SpanId}-{SamplingState}-{ParentSpanId}
+	// a header with only the sampling state is valid, but has no trace to extract
+	parts := strings.Split(h, "-")
+	if len(parts) < 2 {
+		return SpanContext{}, false
+	}
+	traceId, ok := normalizeB3TraceId(parts[0])
+	if !ok || !isValidHexId(parts[1], 16) {
+		return SpanContext{}, false
+	}
+	sc := SpanContext{TraceId: traceId, SpanId: parts[1]}
+	if len(parts) >= 3 {
+		sc.Sampled = parts[2] == "1" || parts[2] == "d"
+	}
+	return sc, true
+}
+
+func extractB3Multi(header http.Header) (SpanContext, bool) {
+	traceId, ok := normalizeB3TraceId(header.Get(b3TraceIdHeader))
+	if !ok {
+		return SpanContext{}, false
+	}
+	sc := SpanContext{TraceId: traceId}
+	if spanId := header.Get(b3SpanIdHeader); isValidHexId(spanId, 16) {
+		sc.SpanId = spanId
+	}
+	switch strings.ToLower(header.Get(b3SampledHeader)) {
+	case "1", "true":
+		sc.Sampled = true
+	}
+	// debug flag implies an accept sampling decision
+	if header.Get(b3FlagsHeader) == "1" {
+		sc.Sampled = true
+	}
+	return sc, true
+}
+
+// normalizeB3TraceId converts 64-bit trace ids to 128-bit by left-padding with zeros.
+func normalizeB3TraceId(id string) (string, bool) {
+	id = strings.ToLower(strings.TrimSpace(id))
+	if len(id) == 16 {
+		id = strings.Repeat("0", 16) + id
+	}
+	if !isValidHexId(id, 32) {
+		return "", false
+	}
+	return id, true
+}
+
+// isHex reports whether s is a lowercase hex string of the given length.
+func isHex(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// isValidHexId reports whether id is a lowercase hex string of the given length which is not all zeros.
+func isValidHexId(id string, length int) bool {
+	return isHex(id, length) && strings.Trim(id, "0") != ""
+}
+
+func extractSpanContext(r *http.Request, propagators []Propagator) (SpanContext, bool) {
+	for _, p := range propagators {
+		if sc, ok := p.Extract(r); ok {
+			return sc, true
+		}
+	}
+	return SpanContext{}, false
+}
@@ -0,0 +1,186 @@
+package stackdriverlog
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestPropagators(t *testing.T) {
+	tests := []struct {
+		name       string
+		propagator Propagator
+		header     map[string]string
+		expected   SpanContext
+		ok         bool
+	}{
+		{
+			"cloud trace context",
+			&CloudTraceContextPropagator{},
+			map[string]string{"X-Cloud-Trace-Context": "105445aa7843bc8bf206b12000100000/1;o=1"},
+			SpanContext{TraceId: "105445aa7843bc8bf206b12000100000", SpanId: "0000000000000001", Sampled: true},
+			true,
+		},
+		{
+			"cloud trace context without span",
+			&CloudTraceContextPropagator{},
+			map[string]string{"X-Cloud-Trace-Context": "105445aa7843bc8bf206b12000100000"},
+			SpanContext{TraceId: "105445aa7843bc8bf206b12000100000"},
+			true,
+		},
+		{
+			"invalid cloud trace context",
+			&CloudTraceContextPropagator{},
+			map[string]string{"X-Cloud-Trace-Context": "invalid/1;o=1"},
+			SpanContext{},
+			false,
+		},
+		{
+			"traceparent",
+			&TraceContextPropagator{},
+			map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+			SpanContext{TraceId: "4bf92f3577b34da6a3ce929d0e0e4736", SpanId: "00f067aa0ba902b7", Sampled: true},
+			true,
+		},
+		{
+			"traceparent not sampled",
+			&TraceContextPropagator{},
+			map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"},
+			SpanContext{TraceId: "4bf92f3577b34da6a3ce929d0e0e4736", SpanId: "00f067aa0ba902b7"},
+			true,
+		},
+		{
+			"traceparent with zero trace id",
+			&TraceContextPropagator{},
+			map[string]string{"traceparent": "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+			SpanContext{},
+			false,
+		},
+		{
+			"traceparent with invalid version",
+			&TraceContextPropagator{},
+			map[string]string{"traceparent": "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+			SpanContext{},
+			false,
+		},
+		{
+			"b3 single",
+			&B3Propagator{},
+			map[string]string{"b3": "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1-05e3ac9a4f6e3b90"},
+			SpanContext{TraceId: "80f198ee56343ba864fe8b2a57d3eff7", SpanId: "e457b5a2e4d86bd1", Sampled: true},
+			true,
+		},
+		{
+			"b3 single with 64-bit trace id",
+			&B3Propagator{},
+			map[string]string{"b3": "64fe8b2a57d3eff7-e457b5a2e4d86bd1"},
+			SpanContext{TraceId: "000000000000000064fe8b2a57d3eff7", SpanId: "e457b5a2e4d86bd1"},
+			true,
+		},
+		{
+			"b3 single with sampling state only",
+			&B3Propagator{},
+			map[string]string{"b3": "0"},
+			SpanContext{},
+			false,
+		},
+		{
+			"b3 multi",
+			&B3Propagator{},
+			map[string]string{
+				"X-B3-TraceId": "80f198ee56343ba864fe8b2a57d3eff7",
+				"X-B3-SpanId":  "e457b5a2e4d86bd1",
+				"X-B3-Sampled": "1",
+			},
+			SpanContext{TraceId: "80f198ee56343ba864fe8b2a57d3eff7", SpanId: "e457b5a2e4d86bd1", Sampled: true},
+			true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/", nil)
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			sc, ok := tt.propagator.Extract(r)
+			if ok != tt.ok {
+				t.Fatalf("ok: got %v, want %v", ok, tt.ok)
+			}
+			if sc != tt.expected {
+				t.Errorf("got %+v, want %+v", sc, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPropagatorPriority(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Cloud-Trace-Context", "105445aa7843bc8bf206b12000100000/1;o=1")
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	config := NewConfig("test")
+	if sc, _ := getRemoteSpanContext(r, config); sc.TraceId != "105445aa7843bc8bf206b12000100000" {
+		t.Errorf("unexpected trace id with default propagators: %s", sc.TraceId)
+	}
+
+	config.Propagators = []Propagator{&TraceContextPropagator{}, &CloudTraceContextPropagator{}}
+	if sc, _ := getRemoteSpanContext(r, config); sc.TraceId != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("unexpected trace id with custom propagators: %s", sc.TraceId)
+	}
+}
+
+// childTracerProvider starts non-recording spans with a fixed span ID under the parent in the context.
+type childTracerProvider struct {
+	noop.TracerProvider
+}
+
+func (childTracerProvider) Tracer(string, ...oteltrace.TracerOption) oteltrace.Tracer {
+	return childTracer{}
+}
+
+type childTracer struct {
+	noop.Tracer
+}
+
+func (childTracer) Start(ctx context.Context, name string, opts ...oteltrace.SpanStartOption) (context.Context, oteltrace.Span) {
+	parent := oteltrace.SpanContextFromContext(ctx)
+	sc := parent.WithSpanID(oteltrace.SpanID{0, 0, 0, 0, 0, 0, 0, 2}).WithRemote(false)
+	return noop.Tracer{}.Start(oteltrace.ContextWithSpanContext(ctx, sc), name, opts...)
+}
+
+func TestServerSpanUnderRemoteSpan(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	config := NewConfig("test")
+	config.RequestLogOut = new(bytes.Buffer)
+	config.ContextLogOut = new(bytes.Buffer)
+	config.TracerProvider = childTracerProvider{}
+
+	var sc oteltrace.SpanContext
+	var logger *ContextLogger
+	handler := RequestLogging(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sc = oteltrace.SpanContextFromContext(r.Context())
+		logger = RequestContextLogger(r)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if got := sc.TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("unexpected trace id in the request context: %s", got)
+	}
+	if got := sc.SpanID().String(); got != "0000000000000002" {
+		t.Errorf("server span is not in the request context: %s", got)
+	}
+	if logger.SpanId != "0000000000000002" {
+		t.Errorf("server span is not logged: %s", logger.SpanId)
+	}
+	if !logger.TraceSampled {
+		t.Error("sampled flag of the remote span is not propagated")
+	}
+}
@@ -0,0 +1,349 @@
+package stackdriverlog
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// wrappedResponseWriter records the status and the size of the response.
+type wrappedResponseWriter struct {
+	http.ResponseWriter
+	status       int
+	responseSize atomic.Int64 // written also by hijacked connections
+}
+
+func (w *wrappedResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *wrappedResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.responseSize.Add(int64(n))
+	return n, err
+}
+
+// Flush implements http.Flusher
+func (w *wrappedResponseWriter) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+// Hijack implements http.Hijacker
+// The hijacked connection is recorded with status 101 (Switching Protocols),
+// and bytes written to the connection are counted as the response size.
+func (w *wrappedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err != nil {
+		return conn, rw, err
+	}
+	w.status = http.StatusSwitchingProtocols
+
+	cc := &countingConn{Conn: conn, n: &w.responseSize}
+	if rw != nil && rw.Writer.Buffered() == 0 {
+		rw.Writer.Reset(cc)
+	}
+	return cc, rw, nil
+}
+
+// Push implements http.Pusher
+func (w *wrappedResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return w.ResponseWriter.(http.Pusher).Push(target, opts)
+}
+
+// CloseNotify implements http.CloseNotifier, which is deprecated but still used by old libraries
+func (w *wrappedResponseWriter) CloseNotify() <-chan bool {
+	return w.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
+
+// ReadFrom implements io.ReaderFrom
+func (w *wrappedResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.(io.ReaderFrom).ReadFrom(r)
+	w.responseSize.Add(n)
+	return n, err
+}
+
+// Unwrap returns the original writer for http.ResponseController
+func (w *wrappedResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type unwrapper interface {
+	Unwrap() http.ResponseWriter
+}
+
+// wrap returns the writer which implements exactly the same optional interfaces as the original writer.
+func (w *wrappedResponseWriter) wrap() http.ResponseWriter {
+	_, isFlusher := w.ResponseWriter.(http.Flusher)
+	_, isHijacker := w.ResponseWriter.(http.Hijacker)
+	_, isPusher := w.ResponseWriter.(http.Pusher)
+	_, isCloseNotifier := w.ResponseWriter.(http.CloseNotifier)
+	_, isReaderFrom := w.ResponseWriter.(io.ReaderFrom)
+
+	switch {
+	case !isFlusher && !isHijacker && !isPusher && !isCloseNotifier && !isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+		}{w, w}
+	case isFlusher && !isHijacker && !isPusher && !isCloseNotifier && !isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Flusher
+		}{w, w, w}
+	case !isFlusher && isHijacker && !isPusher && !isCloseNotifier && !isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Hijacker
+		}{w, w, w}
+	case isFlusher && isHijacker && !isPusher && !isCloseNotifier && !isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Flusher
+			http.Hijacker
+		}{w, w, w, w}
+	case !isFlusher && !isHijacker && isPusher && !isCloseNotifier && !isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Pusher
+		}{w, w, w}
+	case isFlusher && !isHijacker && isPusher && !isCloseNotifier && !isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Flusher
+			http.Pusher
+		}{w, w, w, w}
+	case !isFlusher && isHijacker && isPusher && !isCloseNotifier && !isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Hijacker
+			http.Pusher
+		}{w, w, w, w}
+	case isFlusher && isHijacker && isPusher && !isCloseNotifier && !isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{w, w, w, w, w}
+	case !isFlusher && !isHijacker && !isPusher && isCloseNotifier && !isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.CloseNotifier
+		}{w, w, w}
+	case isFlusher && !isHijacker && !isPusher && isCloseNotifier && !isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Flusher
+			http.CloseNotifier
+		}{w, w, w, w}
+	case !isFlusher && isHijacker && !isPusher && isCloseNotifier && !isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Hijacker
+			http.CloseNotifier
+		}{w, w, w, w}
+	case isFlusher && isHijacker && !isPusher && isCloseNotifier && !isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Flusher
+			http.Hijacker
+			http.CloseNotifier
+		}{w, w, w, w, w}
+	case !isFlusher && !isHijacker && isPusher && isCloseNotifier && !isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Pusher
+			http.CloseNotifier
+		}{w, w, w, w}
+	case isFlusher && !isHijacker && isPusher && isCloseNotifier && !isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Flusher
+			http.Pusher
+			http.CloseNotifier
+		}{w, w, w, w, w}
+	case !isFlusher && isHijacker && isPusher && isCloseNotifier && !isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Hijacker
+			http.Pusher
+			http.CloseNotifier
+		}{w, w, w, w, w}
+	case isFlusher && isHijacker && isPusher && isCloseNotifier && !isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+			http.CloseNotifier
+		}{w, w, w, w, w, w}
+	case !isFlusher && !isHijacker && !isPusher && !isCloseNotifier && isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			io.ReaderFrom
+		}{w, w, w}
+	case isFlusher && !isHijacker && !isPusher && !isCloseNotifier && isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Flusher
+			io.ReaderFrom
+		}{w, w, w, w}
+	case !isFlusher && isHijacker && !isPusher && !isCloseNotifier && isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Hijacker
+			io.ReaderFrom
+		}{w, w, w, w}
+	case isFlusher && isHijacker && !isPusher && !isCloseNotifier && isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{w, w, w, w, w}
+	case !isFlusher && !isHijacker && isPusher && !isCloseNotifier && isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Pusher
+			io.ReaderFrom
+		}{w, w, w, w}
+	case isFlusher && !isHijacker && isPusher && !isCloseNotifier && isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Flusher
+			http.Pusher
+			io.ReaderFrom
+		}{w, w, w, w, w}
+	case !isFlusher && isHijacker && isPusher && !isCloseNotifier && isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Hijacker
+			http.Pusher
+			io.ReaderFrom
+		}{w, w, w, w, w}
+	case isFlusher && isHijacker && isPusher && !isCloseNotifier && isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+			io.ReaderFrom
+		}{w, w, w, w, w, w}
+	case !isFlusher && !isHijacker && !isPusher && isCloseNotifier && isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.CloseNotifier
+			io.ReaderFrom
+		}{w, w, w, w}
+	case isFlusher && !isHijacker && !isPusher && isCloseNotifier && isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Flusher
+			http.CloseNotifier
+			io.ReaderFrom
+		}{w, w, w, w, w}
+	case !isFlusher && isHijacker && !isPusher && isCloseNotifier && isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Hijacker
+			http.CloseNotifier
+			io.ReaderFrom
+		}{w, w, w, w, w}
+	case isFlusher && isHijacker && !isPusher && isCloseNotifier && isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Flusher
+			http.Hijacker
+			http.CloseNotifier
+			io.ReaderFrom
+		}{w, w, w, w, w, w}
+	case !isFlusher && !isHijacker && isPusher && isCloseNotifier && isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Pusher
+			http.CloseNotifier
+			io.ReaderFrom
+		}{w, w, w, w, w}
+	case isFlusher && !isHijacker && isPusher && isCloseNotifier && isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Flusher
+			http.Pusher
+			http.CloseNotifier
+			io.ReaderFrom
+		}{w, w, w, w, w, w}
+	case !isFlusher && isHijacker && isPusher && isCloseNotifier && isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Hijacker
+			http.Pusher
+			http.CloseNotifier
+			io.ReaderFrom
+		}{w, w, w, w, w, w}
+	case isFlusher && isHijacker && isPusher && isCloseNotifier && isReaderFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+			http.CloseNotifier
+			io.ReaderFrom
+		}{w, w, w, w, w, w, w}
+	}
+	return w // unreachable
+}
+
+// countingConn counts bytes written to the connection.
+type countingConn struct {
+	net.Conn
+	n *atomic.Int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,88 @@
+package stackdriverlog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWrappedResponseWriterInterfaces(t *testing.T) {
+	w := &wrappedResponseWriter{ResponseWriter: httptest.NewRecorder()}
+	wrapped := w.wrap()
+
+	if _, ok := wrapped.(http.Flusher); !ok {
+		t.Error("http.Flusher is not preserved")
+	}
+	if _, ok := wrapped.(http.Hijacker); ok {
+		t.Error("http.Hijacker is exposed though the original writer doesn't support it")
+	}
+	if _, ok := wrapped.(io.ReaderFrom); ok {
+		t.Error("io.ReaderFrom is exposed though the original writer doesn't support it")
+	}
+
+	if err := http.NewResponseController(wrapped).Flush(); err != nil {
+		t.Errorf("failed to flush with ResponseController: %v", err)
+	}
+	if w.status != http.StatusOK {
+		t.Errorf("unexpected status: %d", w.status)
+	}
+}
+
+func TestHijack(t *testing.T) {
+	requestLogOut := new(bytes.Buffer)
+	config := NewConfig("test")
+	config.RequestLogOut = requestLogOut
+	config.ContextLogOut = new(bytes.Buffer)
+
+	response := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: test\r\nConnection: Upgrade\r\n\r\n"
+	handler := RequestLogging(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(io.ReaderFrom); !ok {
+			t.Error("io.ReaderFrom is not preserved")
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString(response)
+		rw.Flush()
+	}))
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\nUpgrade: test\r\nConnection: Upgrade\r\n\r\n"))
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status: %d", res.StatusCode)
+	}
+	<-done
+
+	var httpRequestLog HttpRequestLog
+	if err := json.Unmarshal(requestLogOut.Bytes(), &httpRequestLog); err != nil {
+		t.Fatal(err)
+	}
+	if httpRequestLog.HttpRequest.Status != http.StatusSwitchingProtocols {
+		t.Errorf("unexpected status: %d", httpRequestLog.HttpRequest.Status)
+	}
+	if httpRequestLog.HttpRequest.ResponseSize != "72" {
+		t.Errorf("unexpected response size: %s", httpRequestLog.HttpRequest.ResponseSize)
+	}
+}
@@ -0,0 +1,186 @@
+package stackdriverlog
+
+import (
+	"hash/fnv"
+	"net/http"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SamplingRule is the rule to sample request logs.
+// Empty conditions match any request.
+type SamplingRule struct {
+	// Path is the pattern of the request path in the syntax of `path.Match`, e.g. "/healthz", "/static/*"
+	Path string
+
+	// Methods are the request methods, e.g. "GET"
+	Methods []string
+
+	// StatusClass is the first digit of the status code, e.g. 2 for 2xx
+	StatusClass int
+
+	// MinLatency is the minimum latency of the request
+	MinLatency time.Duration
+
+	// Rate is the ratio of request logs to keep, from 0 to 1 (keep all).
+	// If zero, it's treated as 1. Use Drop to drop all.
+	Rate float64
+
+	// Drop drops all request logs matching the rule regardless of Rate
+	Drop bool
+}
+
+// rate returns the ratio of request logs to keep.
+func (rule *SamplingRule) rate() float64 {
+	switch {
+	case rule.Drop:
+		return 0
+	case rule.Rate == 0:
+		return 1
+	}
+	return rule.Rate
+}
+
+// Sampler decides whether to write the request log with the first matching rule.
+// Requests which match no rule are always logged.
+//
+// The decision is derived from the trace ID, so the same trace is kept or dropped consistently
+// across services sampling at the same rate. Context logs are discarded together with the dropped request log.
+// For that, if `Config.Buffer` is nil, context logs of requests which may be dropped by the path and method
+// are held until the end of the request, up to 1 MiB per request. If the limit is exceeded, the oldest logs
+// are dropped, and the number of dropped logs is written when the request log is kept.
+type Sampler struct {
+	rules []SamplingRule
+	stats []samplingCounter // for each rule, and requests matching no rule at the end
+}
+
+type samplingCounter struct {
+	kept    atomic.Uint64
+	dropped atomic.Uint64
+}
+
+// SamplingStats is the number of request logs kept and dropped by the sampler.
+type SamplingStats struct {
+	Kept    uint64
+	Dropped uint64
+
+	// Rules are stats of each rule in the same order as the rules
+	Rules []SamplingRuleStats
+}
+
+// SamplingRuleStats is the number of request logs kept and dropped by the rule.
+type SamplingRuleStats struct {
+	Kept    uint64
+	Dropped uint64
+}
+
+// NewSampler creates a sampler with the rules, which are evaluated in order.
+func NewSampler(rules ...SamplingRule) *Sampler {
+	return &Sampler{
+		rules: rules,
+		stats: make([]samplingCounter, len(rules)+1),
+	}
+}
+
+// Stats returns the number of request logs kept and dropped so far.
+func (s *Sampler) Stats() SamplingStats {
+	var stats SamplingStats
+	for i := range s.stats {
+		kept, dropped := s.stats[i].kept.Load(), s.stats[i].dropped.Load()
+		stats.Kept += kept
+		stats.Dropped += dropped
+		if i < len(s.rules) {
+			stats.Rules = append(stats.Rules, SamplingRuleStats{Kept: kept, Dropped: dropped})
+		}
+	}
+	return stats
+}
+
+// sample reports whether the request log should be kept.
+func (s *Sampler) sample(r *http.Request, status int, elapsed time.Duration, traceId string) bool {
+	idx := len(s.rules)
+	keep := true
+	for i, rule := range s.rules {
+		if rule.match(r, status, elapsed) {
+			idx = i
+			keep = traceRatio(traceId) < rule.rate()
+			break
+		}
+	}
+
+	if keep {
+		s.stats[idx].kept.Add(1)
+	} else {
+		s.stats[idx].dropped.Add(1)
+	}
+	return keep
+}
+
+// mayDrop reports whether the request log may be dropped, judging from the request only.
+func (s *Sampler) mayDrop(r *http.Request) bool {
+	for _, rule := range s.rules {
+		if !rule.matchRequest(r) {
+			continue
+		}
+		if rule.rate() < 1 {
+			return true
+		}
+		if rule.StatusClass == 0 && rule.MinLatency == 0 {
+			// the rule matches regardless of the response, so later rules are never evaluated
+			return false
+		}
+	}
+	return false
+}
+
+func (rule *SamplingRule) match(r *http.Request, status int, elapsed time.Duration) bool {
+	if !rule.matchRequest(r) {
+		return false
+	}
+	if rule.StatusClass != 0 && status/100 != rule.StatusClass {
+		return false
+	}
+	if elapsed < rule.MinLatency {
+		return false
+	}
+	return true
+}
+
+// matchRequest reports whether the conditions known before the response match.
+func (rule *SamplingRule) matchRequest(r *http.Request) bool {
+	if rule.Path != "" {
+		if ok, _ := path.Match(rule.Path, r.URL.Path); !ok {
+			return false
+		}
+	}
+	if len(rule.Methods) > 0 {
+		found := false
+		for _, m := range rule.Methods {
+			if strings.EqualFold(m, r.Method) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// traceRatio maps the trace ID to [0, 1) uniformly.
+func traceRatio(traceId string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(traceId))
+	n := h.Sum64()
+	// finalizer of splitmix64 to spread the bits of similar IDs
+	n ^= n >> 30
+	n *= 0xbf58476d1ce4e5b9
+	n ^= n >> 27
+	n *= 0x94d049bb133111eb
+	n ^= n >> 31
+	// use the upper 53 bits to convert to float64 without rounding to 1
+	return float64(n>>11) / (1 << 53)
+}
@@ -0,0 +1,185 @@
+package stackdriverlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSampler(t *testing.T) {
+	sampler := NewSampler(
+		SamplingRule{MinLatency: time.Second, Rate: 1},
+		SamplingRule{StatusClass: 5, Rate: 1},
+		SamplingRule{Path: "/healthz", Methods: []string{"GET"}, StatusClass: 2, Rate: 0.01},
+	)
+
+	kept := 0
+	for i := 0; i < 10000; i++ {
+		r, _ := http.NewRequest("GET", "/healthz", nil)
+		if sampler.sample(r, 200, time.Millisecond, fmt.Sprintf("%032x", i*7919+1)) {
+			kept++
+		}
+	}
+	if kept < 50 || kept > 200 {
+		t.Errorf("unexpected number of kept logs at 1%%: %d", kept)
+	}
+
+	r, _ := http.NewRequest("GET", "/healthz", nil)
+	if !sampler.sample(r, 503, time.Millisecond, "4bf92f3577b34da6a3ce929d0e0e4736") {
+		t.Error("5xx request is dropped")
+	}
+	if !sampler.sample(r, 200, 2*time.Second, "4bf92f3577b34da6a3ce929d0e0e4736") {
+		t.Error("slow request is dropped")
+	}
+	r, _ = http.NewRequest("POST", "/healthz", nil)
+	if !sampler.sample(r, 200, time.Millisecond, "4bf92f3577b34da6a3ce929d0e0e4736") {
+		t.Error("request matching no rule is dropped")
+	}
+
+	stats := sampler.Stats()
+	if stats.Kept != uint64(kept)+3 || stats.Dropped != uint64(10000-kept) {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	if stats.Rules[0].Kept != 1 || stats.Rules[1].Kept != 1 || stats.Rules[2].Kept != uint64(kept) {
+		t.Errorf("unexpected rule stats: %+v", stats.Rules)
+	}
+}
+
+func TestSamplingDecisionIsConsistent(t *testing.T) {
+	rule := SamplingRule{Rate: 0.5}
+	r, _ := http.NewRequest("GET", "/", nil)
+	for i := 0; i < 100; i++ {
+		traceId := fmt.Sprintf("%032x", i*104729+1)
+		s1, s2 := NewSampler(rule), NewSampler(rule)
+		if s1.sample(r, 200, 0, traceId) != s2.sample(r, 200, 0, traceId) {
+			t.Fatalf("inconsistent decision for %s", traceId)
+		}
+	}
+}
+
+func TestSampledOutRequest(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/healthz", nil)
+	w := httptest.NewRecorder()
+
+	requestLogOut := new(bytes.Buffer)
+	contextLogOut := new(bytes.Buffer)
+
+	config := NewConfig("test")
+	config.RequestLogOut = requestLogOut
+	config.ContextLogOut = contextLogOut
+	config.Buffer = &BufferConfig{}
+	config.Sampler = NewSampler(SamplingRule{Path: "/healthz", Drop: true})
+	handler := RequestLogging(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		RequestContextLogger(r).Infof("ok")
+	}))
+	handler.ServeHTTP(w, r)
+
+	if requestLogOut.Len() != 0 {
+		t.Errorf("request log is written: %s", requestLogOut.String())
+	}
+	if contextLogOut.Len() != 0 {
+		t.Errorf("buffered context log is written: %s", contextLogOut.String())
+	}
+}
+
+func TestSamplingWithoutBuffer(t *testing.T) {
+	config := NewConfig("test")
+	config.RequestLogOut = new(bytes.Buffer)
+	config.Sampler = NewSampler(SamplingRule{Path: "/healthz", Drop: true})
+
+	for _, tt := range []struct {
+		path     string
+		expected []string
+	}{
+		{"/healthz", nil},
+		{"/foo", []string{"info", "error"}},
+	} {
+		contextLogOut := new(bytes.Buffer)
+		config.ContextLogOut = contextLogOut
+		handler := RequestLogging(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			logger := RequestContextLogger(r)
+			logger.Debugf("debug")
+			logger.Infof("info")
+			logger.Errorf("error")
+		}))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", tt.path, nil))
+
+		var messages []string
+		for _, log := range strings.Split(strings.TrimSpace(contextLogOut.String()), "\n") {
+			if log == "" {
+				continue
+			}
+			var cLog contextLog
+			if err := json.Unmarshal([]byte(log), &cLog); err != nil {
+				t.Fatal(err)
+			}
+			messages = append(messages, cLog.Message)
+		}
+		if !cmp.Equal(messages, tt.expected) {
+			t.Errorf("%s: diff: %s", tt.path, cmp.Diff(messages, tt.expected))
+		}
+	}
+}
+
+func TestSamplingRuleRate(t *testing.T) {
+	tests := []struct {
+		rule     SamplingRule
+		expected float64
+	}{
+		{SamplingRule{}, 1},
+		{SamplingRule{Rate: 0.1}, 0.1},
+		{SamplingRule{Rate: 0.1, Drop: true}, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.rate(); got != tt.expected {
+			t.Errorf("%+v: got %v, want %v", tt.rule, got, tt.expected)
+		}
+	}
+}
+
+func TestSamplerMayDrop(t *testing.T) {
+	sampler := NewSampler(
+		SamplingRule{StatusClass: 5},
+		SamplingRule{Path: "/healthz", Methods: []string{"GET"}, Rate: 0.01},
+		SamplingRule{Path: "/static/*"},
+		SamplingRule{Drop: true},
+	)
+	tests := []struct {
+		method   string
+		path     string
+		expected bool
+	}{
+		{"GET", "/healthz", true},
+		{"POST", "/healthz", true}, // dropped by the last rule
+		{"GET", "/static/app.js", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		if got := sampler.mayDrop(r); got != tt.expected {
+			t.Errorf("%s %s: got %v, want %v", tt.method, tt.path, got, tt.expected)
+		}
+	}
+}
+
+func TestSamplingDoesNotHoldLogsOfKeptRequests(t *testing.T) {
+	contextLogOut := new(bytes.Buffer)
+	config := NewConfig("test")
+	config.RequestLogOut = new(bytes.Buffer)
+	config.ContextLogOut = contextLogOut
+	config.Sampler = NewSampler(SamplingRule{Path: "/healthz", Drop: true})
+
+	handler := RequestLogging(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		RequestContextLogger(r).Infof("streaming")
+		if contextLogOut.Len() == 0 {
+			t.Error("context log is held for the request which is never dropped")
+		}
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/foo", nil))
+}
@@ -0,0 +1,198 @@
+package stackdriverlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SeverityVar is the severity which can be changed at runtime.
+// It also holds overrides for named loggers created by `ContextLogger.Named`.
+// It's safe for concurrent use.
+type SeverityVar struct {
+	severity  atomic.Int32
+	mu        sync.Mutex                          // serializes updates of overrides
+	overrides atomic.Pointer[map[string]Severity] // replaced on update
+}
+
+// NewSeverityVar creates a SeverityVar with the initial severity.
+func NewSeverityVar(severity Severity) *SeverityVar {
+	v := &SeverityVar{}
+	v.severity.Store(int32(severity))
+	return v
+}
+
+// Severity returns the global severity.
+func (v *SeverityVar) Severity() Severity {
+	return Severity(v.severity.Load())
+}
+
+// Set changes the global severity.
+func (v *SeverityVar) Set(severity Severity) {
+	v.severity.Store(int32(severity))
+}
+
+// SetFor changes the severity of loggers with the name.
+// Names are hierarchical and separated by "." or "/" like package paths,
+// so the override of "db" also applies to "db.query" unless it has its own override.
+func (v *SeverityVar) SetFor(name string, severity Severity) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	overrides := v.Overrides()
+	overrides[name] = severity
+	v.overrides.Store(&overrides)
+}
+
+// DeleteFor removes the override for the name.
+func (v *SeverityVar) DeleteFor(name string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	overrides := v.Overrides()
+	delete(overrides, name)
+	v.overrides.Store(&overrides)
+}
+
+// Overrides returns a copy of the overrides by name.
+func (v *SeverityVar) Overrides() map[string]Severity {
+	copied := make(map[string]Severity)
+	if overrides := v.overrides.Load(); overrides != nil {
+		for k, s := range *overrides {
+			copied[k] = s
+		}
+	}
+	return copied
+}
+
+// SeverityFor returns the severity of loggers with the name.
+func (v *SeverityVar) SeverityFor(name string) Severity {
+	if severity, ok := v.lookup(name); ok {
+		return severity
+	}
+	return v.Severity()
+}
+
+// lookup returns the override of the longest name which matches the name.
+func (v *SeverityVar) lookup(name string) (Severity, bool) {
+	overrides := v.overrides.Load()
+	if overrides == nil || name == "" {
+		return SeverityDefault, false
+	}
+	for {
+		if severity, ok := (*overrides)[name]; ok {
+			return severity, true
+		}
+		i := strings.LastIndexAny(name, "./")
+		if i < 0 {
+			return SeverityDefault, false
+		}
+		name = name[:i]
+	}
+}
+
+// severityState is the response body of the severity handler
+type severityState struct {
+	Severity  string            `json:"severity"`
+	Overrides map[string]string `json:"overrides,omitempty"`
+}
+
+// severityUpdate is the request body of the severity handler
+type severityUpdate struct {
+	Name     string `json:"name,omitempty"`
+	Severity string `json:"severity"`
+}
+
+// NewSeverityHandler creates an admin handler to read and change the severity.
+//
+// GET returns the current severity and overrides, e.g. `{"severity":"INFO","overrides":{"db":"DEBUG"}}`.
+// PUT with `{"severity":"DEBUG"}` changes the global severity, and PUT with `{"name":"db","severity":"DEBUG"}`
+// changes the severity of loggers named "db". An empty severity with a name removes the override.
+//
+// Changes are logged at NOTICE severity to the request-context logger, or to `config.ContextLogOut`
+// if the handler isn't wrapped by `RequestLogging`.
+// The handler doesn't authenticate requests, so it must not be exposed publicly.
+func NewSeverityHandler(v *SeverityVar, config *Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+		case http.MethodPut:
+			var update severityUpdate
+			if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+				http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+				return
+			}
+			if err := applySeverityUpdate(v, update, r, config); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, HEAD, PUT")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		state := severityState{Severity: v.Severity().String()}
+		if overrides := v.Overrides(); len(overrides) > 0 {
+			state.Overrides = make(map[string]string, len(overrides))
+			for name, severity := range overrides {
+				state.Overrides[name] = severity.String()
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+	})
+}
+
+// applySeverityUpdate applies the update and logs it for audit. It returns an error only if the update is invalid.
+func applySeverityUpdate(v *SeverityVar, update severityUpdate, r *http.Request, config *Config) error {
+	var previous string
+	var message string
+	if update.Name == "" {
+		severity, err := ParseSeverity(update.Severity)
+		if err != nil {
+			return err
+		}
+		previous = v.Severity().String()
+		v.Set(severity)
+		message = fmt.Sprintf("global severity changed from %s to %s", previous, severity)
+	} else {
+		previous = "(none)"
+		if severity, ok := v.Overrides()[update.Name]; ok {
+			previous = severity.String()
+		}
+		if update.Severity == "" {
+			v.DeleteFor(update.Name)
+			message = fmt.Sprintf("severity override of %q removed (was %s)", update.Name, previous)
+		} else {
+			severity, err := ParseSeverity(update.Severity)
+			if err != nil {
+				return err
+			}
+			v.SetFor(update.Name, severity)
+			message = fmt.Sprintf("severity of %q changed from %s to %s", update.Name, previous, severity)
+		}
+	}
+
+	logger, ok := loggerFromContext(r.Context())
+	if !ok {
+		logger = NewContextLogger(config)
+	}
+	fields := Fields{
+		"previous": previous,
+		"remoteIp": getRemoteIp(r, config),
+	}
+	if update.Name != "" {
+		fields["logger"] = update.Name
+	}
+	// audit entries are written regardless of the severity threshold, buffering and sampling.
+	// The change is already applied, so a failure is reported in the same way as the middleware
+	entry := logger.newEntry(SeverityNotice, message, fields, callerLocation(1), time.Now(), nil)
+	if err := logger.writeUnbuffered(entry); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+	}
+	return nil
+}
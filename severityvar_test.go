@@ -0,0 +1,175 @@
+package stackdriverlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSeverityVarFor(t *testing.T) {
+	v := NewSeverityVar(SeverityInfo)
+	v.SetFor("db", SeverityDebug)
+	v.SetFor("db.query", SeverityWarning)
+	v.SetFor("github.com/foo/bar", SeverityError)
+
+	tests := []struct {
+		name     string
+		expected Severity
+	}{
+		{"", SeverityInfo},
+		{"http", SeverityInfo},
+		{"db", SeverityDebug},
+		{"db.conn", SeverityDebug},
+		{"db.query", SeverityWarning},
+		{"db.query.slow", SeverityWarning},
+		{"dbx", SeverityInfo},
+		{"github.com/foo/bar/baz", SeverityError},
+	}
+	for _, tt := range tests {
+		if got := v.SeverityFor(tt.name); got != tt.expected {
+			t.Errorf("SeverityFor(%q): got %s, want %s", tt.name, got, tt.expected)
+		}
+	}
+
+	v.DeleteFor("db")
+	if got := v.SeverityFor("db.conn"); got != SeverityInfo {
+		t.Errorf("unexpected severity after delete: %s", got)
+	}
+}
+
+func TestSeverityHandler(t *testing.T) {
+	contextLogOut := new(bytes.Buffer)
+	config := NewConfig("test")
+	config.ContextLogOut = contextLogOut
+	v := NewSeverityVar(SeverityInfo)
+	handler := NewSeverityHandler(v, config)
+
+	do := func(method, body string) (int, string) {
+		r := httptest.NewRequest(method, "/severity", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code, strings.TrimSpace(w.Body.String())
+	}
+
+	if code, body := do("GET", ""); code != 200 || body != `{"severity":"INFO"}` {
+		t.Errorf("unexpected response: %d %s", code, body)
+	}
+	if code, body := do("PUT", `{"severity":"DEBUG"}`); code != 200 || body != `{"severity":"DEBUG"}` {
+		t.Errorf("unexpected response: %d %s", code, body)
+	}
+	if code, body := do("PUT", `{"name":"db","severity":"WARNING"}`); code != 200 || body != `{"severity":"DEBUG","overrides":{"db":"WARNING"}}` {
+		t.Errorf("unexpected response: %d %s", code, body)
+	}
+	if code, body := do("PUT", `{"name":"db","severity":""}`); code != 200 || body != `{"severity":"DEBUG"}` {
+		t.Errorf("unexpected response: %d %s", code, body)
+	}
+	if code, _ := do("PUT", `{"severity":"VERBOSE"}`); code != 400 {
+		t.Errorf("unexpected status for unknown severity: %d", code)
+	}
+	if code, _ := do("POST", `{"severity":"DEBUG"}`); code != 405 {
+		t.Errorf("unexpected status for POST: %d", code)
+	}
+	if v.Severity() != SeverityDebug {
+		t.Errorf("unexpected severity: %s", v.Severity())
+	}
+
+	var audits []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(contextLogOut.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		audits = append(audits, map[string]interface{}{
+			"severity": entry["severity"],
+			"message":  entry["message"],
+			"previous": entry["previous"],
+		})
+	}
+	expected := []map[string]interface{}{
+		{"severity": "NOTICE", "message": "global severity changed from INFO to DEBUG", "previous": "INFO"},
+		{"severity": "NOTICE", "message": `severity of "db" changed from (none) to WARNING`, "previous": "(none)"},
+		{"severity": "NOTICE", "message": `severity override of "db" removed (was WARNING)`, "previous": "WARNING"},
+	}
+	if !cmp.Equal(audits, expected) {
+		t.Errorf("diff: %s", cmp.Diff(audits, expected))
+	}
+}
+
+func TestSeverityHandlerAuditIsNotBuffered(t *testing.T) {
+	contextLogOut := new(bytes.Buffer)
+	config := NewConfig("test")
+	config.RequestLogOut = new(bytes.Buffer)
+	config.ContextLogOut = contextLogOut
+	config.Buffer = &BufferConfig{Fallback: BufferDiscard}
+	config.Sampler = NewSampler(SamplingRule{Drop: true})
+	handler := RequestLogging(config)(NewSeverityHandler(NewSeverityVar(SeverityInfo), config))
+
+	r := httptest.NewRequest("PUT", "/severity", strings.NewReader(`{"severity":"DEBUG"}`))
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if !strings.Contains(contextLogOut.String(), "global severity changed from INFO to DEBUG") {
+		t.Errorf("audit entry is not written: %s", contextLogOut.String())
+	}
+}
+
+// failingSink fails to write all entries
+type failingSink struct{}
+
+func (failingSink) WriteEntry(entry *Entry) error {
+	return errors.New("sink down")
+}
+
+func TestSeverityHandlerAuditFailure(t *testing.T) {
+	config := NewConfig("test")
+	config.ContextLogSink = failingSink{}
+	v := NewSeverityVar(SeverityInfo)
+	handler := NewSeverityHandler(v, config)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("PUT", "/severity", strings.NewReader(`{"severity":"DEBUG"}`)))
+	if body := strings.TrimSpace(w.Body.String()); w.Code != 200 || body != `{"severity":"DEBUG"}` {
+		t.Errorf("unexpected response: %d %s", w.Code, body)
+	}
+}
+
+func TestNamedLoggerSeverity(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/foo", nil)
+	w := httptest.NewRecorder()
+
+	contextLogOut := new(bytes.Buffer)
+	config := NewConfig("test")
+	config.RequestLogOut = new(bytes.Buffer)
+	config.ContextLogOut = contextLogOut
+	config.SeverityVar = NewSeverityVar(SeverityWarning)
+	config.SeverityVar.SetFor("db", SeverityDebug)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/foo", func(w http.ResponseWriter, r *http.Request) {
+		logger := RequestContextLogger(r)
+		logger.Info("skipped")
+		logger.Named("db").Debug("query")
+		logger.Named("db").Named("conn").Debug("connect")
+		logger.Named("http").Info("skipped")
+	})
+	handler := RequestLogging(config)(mux)
+	handler.ServeHTTP(w, r)
+
+	var messages []string
+	for _, line := range strings.Split(strings.TrimSpace(contextLogOut.String()), "\n") {
+		var entry contextLog
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, entry.Message)
+	}
+	expected := []string{"query", "connect"}
+	if !cmp.Equal(messages, expected) {
+		t.Errorf("diff: %s", cmp.Diff(messages, expected))
+	}
+}
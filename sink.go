@@ -0,0 +1,222 @@
+package stackdriverlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is a structured log entry passed to `Sink`.
+// The fields correspond to the fields of LogEntry of Cloud Logging. More details:
+// https://cloud.google.com/logging/docs/reference/v2/rest/v2/LogEntry
+type Entry struct {
+	Severity       Severity
+	Time           time.Time
+	Trace          string
+	SpanId         string
+	TraceSampled   bool
+	SourceLocation *SourceLocation
+	HttpRequest    *HttpRequest
+	Labels         map[string]string
+
+	// Payload is the jsonPayload, e.g. "message", "data" and structured fields.
+	// Values in Payload must not be modified after the entry is passed to a sink.
+	Payload map[string]interface{}
+}
+
+// Message returns the "message" of the payload.
+func (e *Entry) Message() string {
+	msg, _ := e.Payload["message"].(string)
+	return msg
+}
+
+// Sink receives log entries. Implementations must be safe for concurrent use.
+type Sink interface {
+	WriteEntry(entry *Entry) error
+}
+
+// WriterSink is the sink which writes entries to an io.Writer as JSON lines
+// in the format of structured logging of Cloud Logging.
+type WriterSink struct {
+	mu sync.Mutex // serializes writes to w
+	w  io.Writer
+}
+
+// NewWriterSink creates a sink writing to w.
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+// WriteEntry implements Sink
+func (s *WriterSink) WriteEntry(entry *Entry) error {
+	b, err := marshalEntry(entry)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(b, '\n'))
+	return err
+}
+
+// entryHeader is the special fields of the structured log which are mapped to LogEntry fields.
+type entryHeader struct {
+	Time           string            `json:"time"`
+	Trace          string            `json:"logging.googleapis.com/trace"`
+	SpanId         string            `json:"logging.googleapis.com/spanId,omitempty"`
+	TraceSampled   bool              `json:"logging.googleapis.com/trace_sampled,omitempty"`
+	SourceLocation *SourceLocation   `json:"logging.googleapis.com/sourceLocation,omitempty"`
+	Severity       string            `json:"severity"`
+	HttpRequest    *HttpRequest      `json:"httpRequest,omitempty"`
+	Labels         map[string]string `json:"logging.googleapis.com/labels,omitempty"`
+}
+
+// marshalEntry encodes the entry as a single JSON object, where the payload is merged at top level.
+func marshalEntry(entry *Entry) ([]byte, error) {
+	b, err := json.Marshal(&entryHeader{
+		Time:           entry.Time.Format(time.RFC3339Nano),
+		Trace:          entry.Trace,
+		SpanId:         entry.SpanId,
+		TraceSampled:   entry.TraceSampled,
+		SourceLocation: entry.SourceLocation,
+		Severity:       entry.Severity.String(),
+		HttpRequest:    entry.HttpRequest,
+		Labels:         entry.Labels,
+	})
+	if err != nil || len(entry.Payload) == 0 {
+		return b, err
+	}
+
+	payload := make(map[string]interface{}, len(entry.Payload))
+	for k, v := range entry.Payload {
+		if isHeaderKey(k) {
+			k = fieldKeyPrefix + k
+		}
+		payload[k] = v
+	}
+	pb, err := marshalPayload(payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(pb) <= 2 {
+		return b, nil
+	}
+
+	// merge `{...}` and `{...}` into `{...,...}`
+	b = append(b[:len(b)-1], ',')
+	return append(b, pb[1:]...), nil
+}
+
+// marshalPayload marshals the payload. Values which can't be marshalled are replaced with their text representation
+// to keep the entry.
+func marshalPayload(payload map[string]interface{}) ([]byte, error) {
+	b, err := json.Marshal(payload)
+	if err == nil {
+		return b, nil
+	}
+	fallback := make(map[string]interface{}, len(payload))
+	for k, v := range payload {
+		if _, err := json.Marshal(v); err != nil {
+			v = fmt.Sprintf("%+v", v)
+		}
+		fallback[k] = v
+	}
+	return json.Marshal(fallback)
+}
+
+// isHeaderKey reports whether the key is used by entryHeader.
+func isHeaderKey(key string) bool {
+	switch key {
+	case "time", "severity", "httpRequest":
+		return true
+	}
+	return strings.HasPrefix(key, "logging.googleapis.com/")
+}
+
+// ParseEntry parses a line written by `WriterSink`, or by other structured loggers for Cloud Logging.
+// Fields other than the special fields are stored in Payload.
+func ParseEntry(line []byte) (*Entry, error) {
+	var fields map[string]json.RawMessage
+	dec := json.NewDecoder(bytes.NewReader(line))
+	if err := dec.Decode(&fields); err != nil {
+		return nil, err
+	}
+
+	entry := &Entry{}
+	take := func(key string, v interface{}) {
+		if raw, ok := fields[key]; ok {
+			json.Unmarshal(raw, v)
+			delete(fields, key)
+		}
+	}
+	var timestamp, severity string
+	take("time", &timestamp)
+	if timestamp == "" {
+		take("timestamp", &timestamp)
+	}
+	if timestamp != "" {
+		entry.Time, _ = time.Parse(time.RFC3339Nano, timestamp)
+	}
+	take("severity", &severity)
+	entry.Severity, _ = ParseSeverity(severity)
+	take("logging.googleapis.com/trace", &entry.Trace)
+	take("logging.googleapis.com/spanId", &entry.SpanId)
+	take("logging.googleapis.com/trace_sampled", &entry.TraceSampled)
+	take("logging.googleapis.com/sourceLocation", &entry.SourceLocation)
+	take("logging.googleapis.com/labels", &entry.Labels)
+	take("httpRequest", &entry.HttpRequest)
+
+	if len(fields) > 0 {
+		entry.Payload = make(map[string]interface{}, len(fields))
+		for k, raw := range fields {
+			dec := json.NewDecoder(bytes.NewReader(raw))
+			dec.UseNumber()
+			var v interface{}
+			if err := dec.Decode(&v); err != nil {
+				return nil, err
+			}
+			entry.Payload[k] = v
+		}
+	}
+	return entry, nil
+}
+
+// entryOverhead is the approximate size of the special fields of an entry in JSON.
+const entryOverhead = 128
+
+// approximateSize estimates the size of the entry in JSON without encoding it.
+func approximateSize(entry *Entry) int {
+	size := entryOverhead + len(entry.Trace) + len(entry.SpanId)
+	if entry.SourceLocation != nil {
+		size += len(entry.SourceLocation.File) + len(entry.SourceLocation.Line) + len(entry.SourceLocation.Function)
+	}
+	return size + approximateValueSize(entry.Payload)
+}
+
+func approximateValueSize(v interface{}) int {
+	switch v := v.(type) {
+	case string:
+		return len(v) + 2
+	case map[string]interface{}:
+		size := 2
+		for k, e := range v {
+			size += len(k) + 4 + approximateValueSize(e)
+		}
+		return size
+	case Fields:
+		return approximateValueSize(map[string]interface{}(v))
+	case AdditionalData:
+		return approximateValueSize(map[string]interface{}(v))
+	case []interface{}:
+		size := 2
+		for _, e := range v {
+			size += approximateValueSize(e) + 1
+		}
+		return size
+	}
+	return 16
+}
@@ -0,0 +1,125 @@
+package stackdriverlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWriterSink(t *testing.T) {
+	out := new(bytes.Buffer)
+	sink := NewWriterSink(out)
+	entry := &Entry{
+		Severity:       SeverityWarning,
+		Time:           time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Trace:          "projects/test/traces/a",
+		SpanId:         "b",
+		TraceSampled:   true,
+		SourceLocation: &SourceLocation{File: "main.go", Line: "10", Function: "main.main"},
+		Labels:         map[string]string{"env": "test"},
+		Payload:        map[string]interface{}{"message": "hello", "severity": "collision", "ch": make(chan int)},
+	}
+	if err := sink.WriteEntry(entry); err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	delete(got, "ch")
+	expected := map[string]interface{}{
+		"time":                                  "2024-01-01T00:00:00Z",
+		"logging.googleapis.com/trace":          "projects/test/traces/a",
+		"logging.googleapis.com/spanId":         "b",
+		"logging.googleapis.com/trace_sampled":  true,
+		"logging.googleapis.com/sourceLocation": map[string]interface{}{"file": "main.go", "line": "10", "function": "main.main"},
+		"logging.googleapis.com/labels":         map[string]interface{}{"env": "test"},
+		"severity":                              "WARNING",
+		"message":                               "hello",
+		"fields.severity":                       "collision",
+	}
+	if !cmp.Equal(got, expected) {
+		t.Errorf("diff: %s", cmp.Diff(got, expected))
+	}
+}
+
+func TestWriterSinkConcurrently(t *testing.T) {
+	out := new(bytes.Buffer) // not safe for concurrent use
+	sink := NewWriterSink(out)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sink.WriteEntry(&Entry{Severity: SeverityInfo, Payload: map[string]interface{}{"message": "hello"}})
+		}()
+	}
+	wg.Wait()
+	if n := strings.Count(out.String(), "\n"); n != 10 {
+		t.Errorf("unexpected number of entries: %d", n)
+	}
+}
+
+func TestParseEntry(t *testing.T) {
+	line := []byte(`{"time":"2024-01-01T00:00:00Z","logging.googleapis.com/trace":"projects/test/traces/a","severity":"ERROR","httpRequest":{"requestMethod":"GET","status":500},"message":"boom","count":1}`)
+	entry, err := ParseEntry(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Entry{
+		Severity:    SeverityError,
+		Time:        time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Trace:       "projects/test/traces/a",
+		HttpRequest: &HttpRequest{RequestMethod: "GET", Status: 500},
+		Payload:     map[string]interface{}{"message": "boom", "count": json.Number("1")},
+	}
+	if !cmp.Equal(entry, expected) {
+		t.Errorf("diff: %s", cmp.Diff(entry, expected))
+	}
+	if entry.Message() != "boom" {
+		t.Errorf("unexpected message: %s", entry.Message())
+	}
+
+	if _, err := ParseEntry([]byte("plain text")); err == nil {
+		t.Error("expected error")
+	}
+}
+
+// recordingSink records entries for tests
+type recordingSink struct {
+	mu      sync.Mutex
+	entries []*Entry
+}
+
+func (s *recordingSink) WriteEntry(entry *Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, entry)
+	return nil
+}
+
+func TestContextLogSink(t *testing.T) {
+	contextLogSink := &recordingSink{}
+	config := NewConfig("test")
+	config.ContextLogOut = nil
+	config.ContextLogSink = contextLogSink
+	config.AdditionalData = AdditionalData{"service": "foo"}
+
+	logger := &ContextLogger{sink: config.contextLogSink(), AdditionalData: config.AdditionalData}
+	logger.With(Fields{"user": "alice"}).Info("hello")
+
+	if len(contextLogSink.entries) != 1 {
+		t.Fatalf("unexpected number of entries: %d", len(contextLogSink.entries))
+	}
+	expected := map[string]interface{}{"message": "hello", "user": "alice", "data": AdditionalData{"service": "foo"}}
+	if !cmp.Equal(contextLogSink.entries[0].Payload, expected) {
+		t.Errorf("diff: %s", cmp.Diff(contextLogSink.entries[0].Payload, expected))
+	}
+}
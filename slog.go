@@ -0,0 +1,179 @@
+package stackdriverlog
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// SlogHandler is the slog.Handler which writes logs in the same format as ContextLogger.
+// If the context passed to the handler has the request-context logger set by `RequestLogging`,
+// logs are grouped with the request log.
+//
+//	logger := slog.New(stackdriverlog.NewSlogHandler(config))
+//	logger.InfoContext(r.Context(), "hello", "user", userId)
+type SlogHandler struct {
+	config   *Config
+	fallback *ContextLogger // used when the context doesn't have the request-context logger
+	goas     []groupOrAttrs
+}
+
+// groupOrAttrs holds either a group name or a list of attributes added by WithGroup or WithAttrs.
+type groupOrAttrs struct {
+	group string
+	attrs []slog.Attr
+}
+
+// NewSlogHandler creates a slog handler.
+// Logs with a context which doesn't have the request-context logger are written to
+// `config.ContextLogOut` without trace by a logger shared by the handler and the handlers derived from it.
+func NewSlogHandler(config *Config) *SlogHandler {
+	return &SlogHandler{config: config, fallback: NewContextLogger(config)}
+}
+
+// Enabled implements slog.Handler
+func (h *SlogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.enabled(h.logger(ctx), severityFromSlogLevel(level))
+}
+
+// Handle implements slog.Handler
+func (h *SlogHandler) Handle(ctx context.Context, r slog.Record) error {
+	logger := h.logger(ctx)
+	severity := severityFromSlogLevel(r.Level)
+	if !h.enabled(logger, severity) {
+		return nil
+	}
+
+	fields := make(slogGroup)
+	current := fields
+	for _, goa := range h.goas {
+		if goa.group != "" {
+			current = subFields(current, goa.group)
+			continue
+		}
+		for _, a := range goa.attrs {
+			addAttr(current, a)
+		}
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		addAttr(current, a)
+		return true
+	})
+	pruneEmptyGroups(fields)
+
+	t := r.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return logger.writeEntry(severity, r.Message, Fields(fields), pcLocation(r.PC), t, nil)
+}
+
+// WithAttrs implements slog.Handler
+func (h *SlogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+	return h.withGroupOrAttrs(groupOrAttrs{attrs: attrs})
+}
+
+// WithGroup implements slog.Handler
+func (h *SlogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return h.withGroupOrAttrs(groupOrAttrs{group: name})
+}
+
+func (h *SlogHandler) withGroupOrAttrs(goa groupOrAttrs) *SlogHandler {
+	h2 := *h
+	h2.goas = make([]groupOrAttrs, len(h.goas)+1)
+	copy(h2.goas, h.goas)
+	h2.goas[len(h.goas)] = goa
+	return &h2
+}
+
+func (h *SlogHandler) logger(ctx context.Context) *ContextLogger {
+	if l, ok := loggerFromContext(ctx); ok {
+		return l
+	}
+	return h.fallback
+}
+
+func (h *SlogHandler) enabled(logger *ContextLogger, severity Severity) bool {
+	if logger == h.fallback {
+		// the fallback logger lives as long as the handler, so the severity is read on every log
+		return severity >= h.config.severity()
+	}
+	return logger.enabled(severity)
+}
+
+// severityFromSlogLevel maps slog levels to severities.
+// Levels between the standard slog levels are mapped to the severities in between.
+func severityFromSlogLevel(level slog.Level) Severity {
+	switch {
+	case level < slog.LevelInfo:
+		return SeverityDebug
+	case level < slog.LevelInfo+2:
+		return SeverityInfo
+	case level < slog.LevelWarn:
+		return SeverityNotice
+	case level < slog.LevelError:
+		return SeverityWarning
+	case level < slog.LevelError+4:
+		return SeverityError
+	case level < slog.LevelError+8:
+		return SeverityCritical
+	case level < slog.LevelError+12:
+		return SeverityAlert
+	}
+	return SeverityEmergency
+}
+
+// slogGroup holds the attributes of a group
+type slogGroup map[string]interface{}
+
+func addAttr(fields slogGroup, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindGroup:
+		attrs := a.Value.Group()
+		if len(attrs) == 0 {
+			return
+		}
+		// attributes of a group with empty key are inlined
+		group := fields
+		if a.Key != "" {
+			group = subFields(fields, a.Key)
+		}
+		for _, ga := range attrs {
+			addAttr(group, ga)
+		}
+	default:
+		fields[a.Key] = fieldValue(a.Value.Any())
+	}
+}
+
+func subFields(fields slogGroup, key string) slogGroup {
+	if sub, ok := fields[key].(slogGroup); ok {
+		return sub
+	}
+	sub := make(slogGroup)
+	fields[key] = sub
+	return sub
+}
+
+// pruneEmptyGroups removes groups which have no attributes.
+func pruneEmptyGroups(fields slogGroup) {
+	for k, v := range fields {
+		if sub, ok := v.(slogGroup); ok {
+			pruneEmptyGroups(sub)
+			if len(sub) == 0 {
+				delete(fields, k)
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package stackdriverlog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSlogHandler(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/foo", nil)
+	w := httptest.NewRecorder()
+
+	requestLogOut := new(bytes.Buffer)
+	contextLogOut := new(bytes.Buffer)
+
+	config := NewConfig("test")
+	config.RequestLogOut = requestLogOut
+	config.ContextLogOut = contextLogOut
+	logger := slog.New(NewSlogHandler(config)).With("service", "foo")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/foo", func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		logger.DebugContext(ctx, "skipped")
+		logger.InfoContext(ctx, "hello", "user", "alice", slog.Group("req", "id", 1))
+		logger.WithGroup("g").WarnContext(ctx, "warn", "err", errors.New("boom"))
+		logger.Log(ctx, slog.LevelError+4, "critical")
+	})
+	handler := RequestLogging(config)(mux)
+	handler.ServeHTTP(w, r)
+
+	var httpRequestLog HttpRequestLog
+	if err := json.Unmarshal(requestLogOut.Bytes(), &httpRequestLog); err != nil {
+		t.Fatal(err)
+	}
+	if httpRequestLog.Severity != "CRITICAL" {
+		t.Errorf("unexpected request log severity: %s", httpRequestLog.Severity)
+	}
+
+	logs := strings.Split(strings.TrimSpace(contextLogOut.String()), "\n")
+	expected := []map[string]interface{}{
+		{"severity": "INFO", "message": "hello", "service": "foo", "user": "alice", "req": map[string]interface{}{"id": 1.0}},
+		{"severity": "WARNING", "message": "warn", "service": "foo", "g": map[string]interface{}{"err": "boom"}},
+		{"severity": "CRITICAL", "message": "critical", "service": "foo"},
+	}
+	if len(logs) != len(expected) {
+		t.Fatalf("unexpected number of logs: %d", len(logs))
+	}
+	for idx, log := range logs {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(log), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry["logging.googleapis.com/trace"] != httpRequestLog.Trace {
+			t.Errorf("different trace: httpRequestLog=%s, contextLog=%v", httpRequestLog.Trace, entry["logging.googleapis.com/trace"])
+		}
+		location, _ := entry["logging.googleapis.com/sourceLocation"].(map[string]interface{})
+		if location["file"] != "slog_test.go" {
+			t.Errorf("unexpected source location: %v", location)
+		}
+		for _, k := range []string{"time", "logging.googleapis.com/trace", "logging.googleapis.com/spanId", "logging.googleapis.com/trace_sampled", "logging.googleapis.com/sourceLocation"} {
+			delete(entry, k)
+		}
+		if !cmp.Equal(entry, expected[idx]) {
+			t.Errorf("diff: %s", cmp.Diff(entry, expected[idx]))
+		}
+	}
+}
+
+func TestSlogHandlerWithoutRequest(t *testing.T) {
+	contextLogOut := new(bytes.Buffer)
+	config := NewConfig("test")
+	config.ContextLogOut = contextLogOut
+	logger := slog.New(NewSlogHandler(config))
+
+	logger.Info("hello", "message", "collision")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(contextLogOut.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["message"] != "hello" || entry["fields.message"] != "collision" {
+		t.Errorf("unexpected entry: %v", entry)
+	}
+	if entry["logging.googleapis.com/trace"] != "" {
+		t.Errorf("unexpected trace: %v", entry["logging.googleapis.com/trace"])
+	}
+}
+
+func TestSlogHandlerWithoutRequestConcurrently(t *testing.T) {
+	contextLogOut := new(bytes.Buffer) // not safe for concurrent use
+	config := NewConfig("test")
+	config.ContextLogOut = contextLogOut
+	config.SeverityVar = NewSeverityVar(SeverityInfo)
+	handler := NewSlogHandler(config)
+	logger := slog.New(handler)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			logger.With("key", "value").Info("hello")
+		}()
+	}
+	wg.Wait()
+	if n := strings.Count(contextLogOut.String(), "\n"); n != 10 {
+		t.Errorf("unexpected number of logs: %d", n)
+	}
+
+	// the severity is read on every log
+	if handler.Enabled(context.Background(), slog.LevelDebug) {
+		t.Error("debug is enabled")
+	}
+	config.SeverityVar.Set(SeverityDebug)
+	if !handler.Enabled(context.Background(), slog.LevelDebug) {
+		t.Error("debug is not enabled after the severity is changed")
+	}
+}
@@ -2,14 +2,18 @@
 package stackdriverlog
 
 import (
-	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/netip"
 	"os"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 type AdditionalData map[string]interface{}
@@ -24,8 +28,92 @@ type Config struct {
 	// Output for context log (application log)
 	ContextLogOut io.Writer
 
+	// RequestLogSink receives request logs instead of RequestLogOut if set.
+	RequestLogSink Sink
+
+	// ContextLogSink receives context logs instead of ContextLogOut if set.
+	ContextLogSink Sink
+
+	// Format is the output format of RequestLogOut and ContextLogOut. The default is FormatJSON.
+	// It's ignored for outputs whose sink is set.
+	Format Format
+
 	Severity       Severity
 	AdditionalData AdditionalData
+
+	// Propagators extract the trace of an incoming request in order of priority.
+	// `DefaultPropagators()` is used if this is nil.
+	Propagators []Propagator
+
+	// TracerProvider is used to start a span when the request has no trace yet.
+	// The global provider (`otel.GetTracerProvider()`) is used if this is nil.
+	TracerProvider trace.TracerProvider
+
+	// OpenCensusCompatible makes the middleware read and start OpenCensus spans
+	// in addition to OpenTelemetry spans.
+	OpenCensusCompatible bool
+
+	// RecoverPanic makes the middleware recover a panic in the handler.
+	// The panic is logged at CRITICAL severity with the stack trace,
+	// and the request is logged with status 500.
+	RecoverPanic bool
+
+	// Repanic makes the middleware panic again after logging the recovered panic.
+	// This is used only when RecoverPanic is true.
+	Repanic bool
+
+	// TrustedProxies are the address ranges of reverse proxies in front of the server.
+	// If the peer of the request is a trusted proxy, the client IP is read from ForwardedHeader,
+	// skipping trusted proxies from the right.
+	TrustedProxies []netip.Prefix
+
+	// TrustedProxyHops is the number of reverse proxies in front of the server.
+	// If this is set, the client IP is the address that many hops before the peer
+	// in the forwarding headers, and TrustedProxies is ignored.
+	TrustedProxyHops int
+
+	// ForwardedHeader is the header which the trusted proxies write the client IP to:
+	// "X-Forwarded-For", "Forwarded" or "X-Real-IP". The default is "X-Forwarded-For".
+	// Other headers are ignored because they may be sent by the client as they are.
+	ForwardedHeader string
+
+	// ServerIp is logged as the server IP of the request log if set.
+	// Otherwise the server IP is resolved as specified by ServerIpSource.
+	ServerIp string
+
+	// ServerIpSource is how the server IP is resolved. The default is `ServerIpFromInterfaces`.
+	ServerIpSource ServerIpSource
+
+	// ServerIpRefreshInterval is the interval to resolve the server IP from network interfaces again.
+	// If zero, the server IP is resolved only once.
+	ServerIpRefreshInterval time.Duration
+
+	// ServiceContext identifies the service of logs reported to Error Reporting.
+	ServiceContext *ServiceContext
+
+	// ReportErrors makes context logs at ERROR or higher severity reported to Error Reporting
+	// with the stack trace, as `ContextLogger.ReportError` does.
+	ReportErrors bool
+
+	// Buffer makes context logs buffered until the end of the request if set.
+	Buffer *BufferConfig
+
+	// Sampler samples request logs if set.
+	Sampler *Sampler
+
+	// Exclude are filters of requests not to write the request log.
+	// Trace extraction and context logs still work for excluded requests.
+	Exclude []RequestFilter
+
+	// SeverityVar is used instead of Severity if set, so that the severity can be changed at runtime.
+	// The global severity is read at the start of each request, and overrides for named loggers
+	// are read on every log. See `NewSeverityHandler`.
+	SeverityVar *SeverityVar
+
+	// LogLevelHeader allows a signed request header to lower Severity for the request if set.
+	// The result is recorded in the request log for audit. If the header is applied, the request log
+	// and the context logs are written even if the request is excluded or sampled out.
+	LogLevelHeader *LogLevelHeaderConfig
 }
 
 // NewConfig creates a config with default settings.
@@ -36,7 +124,48 @@ func NewConfig(projectId string) *Config {
 		RequestLogOut:  os.Stderr,
 		ContextLogOut:  os.Stdout,
 		AdditionalData: AdditionalData{},
+		Propagators:    DefaultPropagators(),
+	}
+}
+
+// sinks returns the sinks for request logs and context logs of the middleware.
+// In the console format, they share a console sink to group logs by trace.
+func (c *Config) sinks() (requestLogSink Sink, contextLogSink Sink) {
+	if c.Format == FormatConsole && c.RequestLogSink == nil && c.ContextLogSink == nil {
+		console := newConsoleSinkFor(c.ContextLogOut)
+		return console, console
 	}
+	requestLogSink = c.RequestLogSink
+	if requestLogSink == nil {
+		if c.Format == FormatConsole {
+			requestLogSink = newConsoleSinkFor(c.RequestLogOut)
+		} else {
+			requestLogSink = NewWriterSink(c.RequestLogOut)
+		}
+	}
+	return requestLogSink, c.contextLogSink()
+}
+
+// contextLogSink returns the sink for context logs which are not grouped with request logs.
+func (c *Config) contextLogSink() Sink {
+	if c.ContextLogSink != nil {
+		return c.ContextLogSink
+	}
+	if c.Format == FormatConsole {
+		// request logs never come to this sink, so context logs are written without waiting for them
+		console := newConsoleSinkFor(c.ContextLogOut)
+		console.ungrouped = true
+		return console
+	}
+	return NewWriterSink(c.ContextLogOut)
+}
+
+// severity returns the current severity of context logs.
+func (c *Config) severity() Severity {
+	if c.SeverityVar != nil {
+		return c.SeverityVar.Severity()
+	}
+	return c.Severity
 }
 
 // Severity is the level of log. More details:
@@ -86,29 +215,62 @@ type SourceLocation struct {
 	Function string `json:"function"`
 }
 
-type contextLog struct {
-	Time           string         `json:"time"`
-	Trace          string         `json:"logging.googleapis.com/trace"`
-	SourceLocation SourceLocation `json:"logging.googleapis.com/sourceLocation"`
-	Severity       string         `json:"severity"`
-	Message        string         `json:"message"`
-	AdditionalData AdditionalData `json:"data,omitempty"`
+// fieldKeyPrefix is prepended to field keys which collide with the reserved keys of the entry
+const fieldKeyPrefix = "fields."
+
+// isReservedKey reports whether the key is used by the entry itself or has a special meaning in Cloud Logging.
+func isReservedKey(key string) bool {
+	switch key {
+	case "time", "timestamp", "severity", "message", "data", "httpRequest",
+		"@type", "serviceContext", "context", "stack_trace":
+		return true
+	}
+	return strings.HasPrefix(key, "logging.googleapis.com/")
 }
 
 // ContextLogger is the logger which is combined with the request
 type ContextLogger struct {
-	out            io.Writer
+	sink           Sink
 	Trace          string
+	SpanId         string
+	TraceSampled   bool
 	Severity       Severity
 	AdditionalData AdditionalData
-	loggedSeverity []Severity
+	serviceContext *ServiceContext
+	reportErrors   bool
+	errorRequest   *errorHttpRequest
+	fields         Fields
+	parent         *ContextLogger
+
+	name               string       // set by `Named`
+	severityVar        *SeverityVar // overrides Severity for named loggers
+	severityOverridden bool         // Severity is lowered by the log level header
+
+	// following fields are used only by the root logger, see `root()`
+	mu                sync.Mutex   // serializes writes to sink
+	maxLoggedSeverity atomic.Int32 // the highest severity logged so far
+	buffering         atomic.Bool  // whether buffer is set
+	buffer            *logBuffer   // guarded by mu
 }
 
 // RequestContextLogger gets request-context logger for the request.
 // You must use `RequestLogging` middleware in advance for this function to work.
+// Otherwise the fallback logger is returned, see `FromContext`.
 func RequestContextLogger(r *http.Request) *ContextLogger {
-	v, _ := r.Context().Value(contextLoggerKey).(*ContextLogger)
-	return v
+	return FromContext(r.Context())
+}
+
+// NewContextLogger creates a logger which isn't combined with a request, e.g. for background jobs.
+// Its logs are written to the context log output of the config without trace.
+func NewContextLogger(config *Config) *ContextLogger {
+	return &ContextLogger{
+		sink:           config.contextLogSink(),
+		Severity:       config.severity(),
+		AdditionalData: config.AdditionalData,
+		serviceContext: config.ServiceContext,
+		reportErrors:   config.ReportErrors,
+		severityVar:    config.SeverityVar,
+	}
 }
 
 // Default logs a message at DEFAULT severity
@@ -262,48 +424,154 @@ func (l *ContextLogger) Emergencyln(args ...interface{}) {
 }
 
 func (l *ContextLogger) write(severity Severity, msg string) error {
-	if severity < l.Severity {
+	if !l.enabled(severity) {
 		return nil
 	}
 
-	l.loggedSeverity = append(l.loggedSeverity, severity)
+	// skip frames of this function and the logging method
+	return l.writeEntry(severity, msg, nil, callerLocation(2), time.Now(), nil)
+}
+
+func (l *ContextLogger) enabled(severity Severity) bool {
+	return severity >= l.threshold() || l.root().buffering.Load()
+}
+
+// threshold returns the minimum severity to be logged.
+func (l *ContextLogger) threshold() Severity {
+	// the log level header takes precedence since it's requested for the specific request
+	if l.severityVar != nil && !l.severityOverridden {
+		if severity, ok := l.severityVar.lookup(l.name); ok {
+			return severity
+		}
+	}
+	return l.Severity
+}
+
+// writeEntry writes a log entry. The caller must check the severity with `enabled` in advance.
+// If report is not nil, the entry is formatted to be reported to Error Reporting.
+func (l *ContextLogger) writeEntry(severity Severity, msg string, fields Fields, location SourceLocation, t time.Time, report *errorReport) error {
+	entry := l.newEntry(severity, msg, fields, location, t, report)
+
+	root := l.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	if root.buffer != nil {
+		root.buffer.add(entry)
+		return nil
+	}
+	root.recordSeverity(severity)
+	return l.sink.WriteEntry(entry)
+}
+
+// writeUnbuffered writes the entry to the sink even while the logs are buffered.
+func (l *ContextLogger) writeUnbuffered(entry *Entry) error {
+	root := l.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	root.recordSeverity(entry.Severity)
+	return l.sink.WriteEntry(entry)
+}
+
+func (l *ContextLogger) newEntry(severity Severity, msg string, fields Fields, location SourceLocation, t time.Time, report *errorReport) *Entry {
+	if len(l.fields) > 0 {
+		merged := make(Fields, len(l.fields)+len(fields))
+		for k, v := range l.fields {
+			merged[k] = v
+		}
+		for k, v := range fields {
+			merged[k] = v
+		}
+		fields = merged
+	}
 
-	// get source location
-	var location SourceLocation
-	if pc, file, line, ok := runtime.Caller(2); ok {
-		if function := runtime.FuncForPC(pc); function != nil {
-			location.Function = function.Name()
+	payload := make(map[string]interface{}, len(fields)+2)
+	for k, v := range fields {
+		if isReservedKey(k) {
+			k = fieldKeyPrefix + k
 		}
-		location.Line = fmt.Sprintf("%d", line)
-		parts := strings.Split(file, "/")
-		location.File = parts[len(parts)-1] // use short file name
+		payload[k] = v
+	}
+	payload["message"] = msg
+	if len(l.AdditionalData) > 0 {
+		payload["data"] = l.AdditionalData
 	}
 
-	log := &contextLog{
-		Time:           time.Now().Format(time.RFC3339Nano),
+	if report == nil && l.reportErrors && severity >= SeverityError {
+		report = &errorReport{stack: captureStack()}
+	}
+	if report != nil {
+		payload["@type"] = reportedErrorEventType
+		if l.serviceContext != nil {
+			payload["serviceContext"] = l.serviceContext
+		}
+		if report.stack != "" {
+			payload["stack_trace"] = report.stack
+		}
+		if l.errorRequest != nil {
+			payload["context"] = &errorContext{HttpRequest: l.errorRequest}
+		}
+	}
+
+	return &Entry{
+		Severity:       severity,
+		Time:           t,
 		Trace:          l.Trace,
-		SourceLocation: location,
-		Severity:       severity.String(),
-		Message:        msg,
-		AdditionalData: l.AdditionalData,
+		SpanId:         l.SpanId,
+		TraceSampled:   l.TraceSampled,
+		SourceLocation: &location,
+		Payload:        payload,
 	}
+}
 
-	logJson, err := json.Marshal(log)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err.Error())
+// callerLocation returns the source location of the caller.
+// The argument skip is the number of stack frames to skip, 0 identifying the caller of callerLocation.
+func callerLocation(skip int) SourceLocation {
+	if pc, file, line, ok := runtime.Caller(skip + 1); ok {
+		var function string
+		if f := runtime.FuncForPC(pc); f != nil {
+			function = f.Name()
+		}
+		return newSourceLocation(function, file, line)
 	}
-	logJson = append(logJson, '\n')
+	return SourceLocation{}
+}
 
-	_, err = l.out.Write(logJson)
-	return err
+// pcLocation returns the source location of the program counter.
+func pcLocation(pc uintptr) SourceLocation {
+	if pc == 0 {
+		return SourceLocation{}
+	}
+	frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	return newSourceLocation(frame.Function, frame.File, frame.Line)
 }
 
-func (l *ContextLogger) maxSeverity() Severity {
-	max := SeverityDefault
-	for _, s := range l.loggedSeverity {
-		if s > max {
-			max = s
+func newSourceLocation(function, file string, line int) SourceLocation {
+	parts := strings.Split(file, "/")
+	return SourceLocation{
+		File:     parts[len(parts)-1], // use short file name
+		Line:     fmt.Sprintf("%d", line),
+		Function: function,
+	}
+}
+
+// root returns the logger created for the request, which tracks severities of all its child loggers.
+func (l *ContextLogger) root() *ContextLogger {
+	if l.parent != nil {
+		return l.parent
+	}
+	return l
+}
+
+// recordSeverity updates the max severity of the logger.
+func (l *ContextLogger) recordSeverity(severity Severity) {
+	for {
+		current := l.maxLoggedSeverity.Load()
+		if int32(severity) <= current || l.maxLoggedSeverity.CompareAndSwap(current, int32(severity)) {
+			return
 		}
 	}
-	return max
+}
+
+func (l *ContextLogger) maxSeverity() Severity {
+	return Severity(l.root().maxLoggedSeverity.Load())
 }
@@ -4,15 +4,38 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	oteltrace "go.opentelemetry.io/otel/trace"
 )
 
+// contextLog is the JSON format of context logs written by WriterSink
+type contextLog struct {
+	Time           string         `json:"time"`
+	Trace          string         `json:"logging.googleapis.com/trace"`
+	SpanId         string         `json:"logging.googleapis.com/spanId,omitempty"`
+	TraceSampled   bool           `json:"logging.googleapis.com/trace_sampled,omitempty"`
+	SourceLocation SourceLocation `json:"logging.googleapis.com/sourceLocation"`
+	Severity       string         `json:"severity"`
+	Message        string         `json:"message"`
+	AdditionalData AdditionalData `json:"data,omitempty"`
+
+	// for Error Reporting
+	Type           string          `json:"@type,omitempty"`
+	ServiceContext *ServiceContext `json:"serviceContext,omitempty"`
+	Context        *errorContext   `json:"context,omitempty"`
+	StackTrace     string          `json:"stack_trace,omitempty"`
+}
+
 func TestIntegration(t *testing.T) {
 	r, _ := http.NewRequest("GET", "/foo?bar=baz", nil)
 	r.Header.Add("User-Agent", "test")
@@ -51,7 +74,7 @@ func TestIntegration(t *testing.T) {
 	}
 
 	opts := []cmp.Option{
-		cmpopts.IgnoreFields(HttpRequestLog{}, "Time", "Trace"),
+		cmpopts.IgnoreFields(HttpRequestLog{}, "Time", "Trace", "SpanId", "TraceSampled"),
 		cmpopts.IgnoreFields(HttpRequest{}, "RemoteIp", "ServerIp", "Latency"),
 	}
 	expected := HttpRequestLog{
@@ -63,7 +86,7 @@ func TestIntegration(t *testing.T) {
 		HttpRequest: HttpRequest{
 			RequestMethod:                  "GET",
 			RequestUrl:                     "/foo?bar=baz",
-			RequestSize:                    "0",
+			RequestSize:                    "47",
 			Status:                         200,
 			ResponseSize:                   "3",
 			UserAgent:                      "test",
@@ -108,7 +131,7 @@ func TestIntegration(t *testing.T) {
 			},
 		}
 		opts := []cmp.Option{
-			cmpopts.IgnoreFields(contextLog{}, "Time", "Trace", "SourceLocation"),
+			cmpopts.IgnoreFields(contextLog{}, "Time", "Trace", "SpanId", "TraceSampled", "SourceLocation"),
 		}
 		if !cmp.Equal(cLog, expected, opts...) {
 			t.Errorf("diff: %s", cmp.Diff(cLog, expected, opts...))
@@ -148,7 +171,7 @@ func TestNoContextLog(t *testing.T) {
 	}
 
 	opts := []cmp.Option{
-		cmpopts.IgnoreFields(HttpRequestLog{}, "Time", "Trace"),
+		cmpopts.IgnoreFields(HttpRequestLog{}, "Time", "Trace", "SpanId", "TraceSampled"),
 		cmpopts.IgnoreFields(HttpRequest{}, "RemoteIp", "ServerIp", "Latency"),
 	}
 	expected := HttpRequestLog{
@@ -157,7 +180,7 @@ func TestNoContextLog(t *testing.T) {
 		HttpRequest: HttpRequest{
 			RequestMethod:                  "GET",
 			RequestUrl:                     "/foo?bar=baz",
-			RequestSize:                    "0",
+			RequestSize:                    "47",
 			Status:                         200,
 			ResponseSize:                   "3",
 			UserAgent:                      "test",
@@ -177,3 +200,335 @@ func TestNoContextLog(t *testing.T) {
 		t.Errorf("context log exists: %s", string(contextLogOut.Bytes()))
 	}
 }
+
+func TestSpanIdAndTraceSampled(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/foo", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/foo", func(w http.ResponseWriter, r *http.Request) {
+		RequestContextLogger(r).Infof("hello")
+		fmt.Fprintf(w, "OK\n")
+	})
+
+	requestLogOut := new(bytes.Buffer)
+	contextLogOut := new(bytes.Buffer)
+
+	config := NewConfig("test")
+	config.RequestLogOut = requestLogOut
+	config.ContextLogOut = contextLogOut
+	handler := RequestLogging(config)(mux)
+	handler.ServeHTTP(w, r)
+
+	var httpRequestLog HttpRequestLog
+	if err := json.Unmarshal(requestLogOut.Bytes(), &httpRequestLog); err != nil {
+		t.Fatal(err)
+	}
+	var cLog contextLog
+	if err := json.Unmarshal(contextLogOut.Bytes(), &cLog); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedTrace := "projects/test/traces/4bf92f3577b34da6a3ce929d0e0e4736"
+	for _, got := range []struct {
+		Trace        string
+		SpanId       string
+		TraceSampled bool
+	}{
+		{httpRequestLog.Trace, httpRequestLog.SpanId, httpRequestLog.TraceSampled},
+		{cLog.Trace, cLog.SpanId, cLog.TraceSampled},
+	} {
+		if got.Trace != expectedTrace {
+			t.Errorf("unexpected trace: %s", got.Trace)
+		}
+		if got.SpanId != "00f067aa0ba902b7" {
+			t.Errorf("unexpected span id: %s", got.SpanId)
+		}
+		if !got.TraceSampled {
+			t.Errorf("trace is not sampled")
+		}
+	}
+}
+
+func TestOpenTelemetrySpan(t *testing.T) {
+	traceId, _ := oteltrace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanId, _ := oteltrace.SpanIDFromHex("00f067aa0ba902b7")
+	sc := oteltrace.NewSpanContext(oteltrace.SpanContextConfig{
+		TraceID:    traceId,
+		SpanID:     spanId,
+		TraceFlags: oteltrace.FlagsSampled,
+	})
+
+	r, _ := http.NewRequest("GET", "/foo", nil)
+	r = r.WithContext(oteltrace.ContextWithSpanContext(r.Context(), sc))
+	// the active span takes precedence over the header
+	r.Header.Set("X-Cloud-Trace-Context", "105445aa7843bc8bf206b12000100000/1;o=1")
+	w := httptest.NewRecorder()
+
+	requestLogOut := new(bytes.Buffer)
+	config := NewConfig("test")
+	config.RequestLogOut = requestLogOut
+	config.ContextLogOut = new(bytes.Buffer)
+	handler := RequestLogging(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	handler.ServeHTTP(w, r)
+
+	var httpRequestLog HttpRequestLog
+	if err := json.Unmarshal(requestLogOut.Bytes(), &httpRequestLog); err != nil {
+		t.Fatal(err)
+	}
+	if httpRequestLog.Trace != "projects/test/traces/4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("unexpected trace: %s", httpRequestLog.Trace)
+	}
+	if httpRequestLog.SpanId != "00f067aa0ba902b7" {
+		t.Errorf("unexpected span id: %s", httpRequestLog.SpanId)
+	}
+}
+
+func TestGenerateSpanContext(t *testing.T) {
+	var got oteltrace.SpanContext
+	r, _ := http.NewRequest("GET", "/foo", nil)
+	w := httptest.NewRecorder()
+
+	requestLogOut := new(bytes.Buffer)
+	config := NewConfig("test")
+	config.RequestLogOut = requestLogOut
+	config.ContextLogOut = new(bytes.Buffer)
+	handler := RequestLogging(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = oteltrace.SpanContextFromContext(r.Context())
+	}))
+	handler.ServeHTTP(w, r)
+
+	if !got.IsValid() {
+		t.Fatal("span context is not set to the request")
+	}
+	var httpRequestLog HttpRequestLog
+	if err := json.Unmarshal(requestLogOut.Bytes(), &httpRequestLog); err != nil {
+		t.Fatal(err)
+	}
+	if httpRequestLog.Trace != "projects/test/traces/"+got.TraceID().String() {
+		t.Errorf("unexpected trace: %s", httpRequestLog.Trace)
+	}
+}
+
+func TestConcurrentContextLog(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/foo", nil)
+	w := httptest.NewRecorder()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/foo", func(w http.ResponseWriter, r *http.Request) {
+		logger := RequestContextLogger(r)
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				child := logger.With(Fields{"worker": i})
+				for j := 0; j < 100; j++ {
+					if i == 5 && j == 50 {
+						child.Errorf("error")
+						continue
+					}
+					child.Infof("%d", j)
+					logger.Warnf("%d", j)
+				}
+			}(i)
+		}
+		wg.Wait()
+	})
+
+	requestLogOut := new(bytes.Buffer)
+	contextLogOut := new(bytes.Buffer)
+
+	config := NewConfig("test")
+	config.RequestLogOut = requestLogOut
+	config.ContextLogOut = contextLogOut
+	handler := RequestLogging(config)(mux)
+	handler.ServeHTTP(w, r)
+
+	var httpRequestLog HttpRequestLog
+	if err := json.Unmarshal(requestLogOut.Bytes(), &httpRequestLog); err != nil {
+		t.Fatal(err)
+	}
+	if httpRequestLog.Severity != "ERROR" {
+		t.Errorf("unexpected severity: %s", httpRequestLog.Severity)
+	}
+
+	logs := strings.Split(strings.TrimSpace(contextLogOut.String()), "\n")
+	if len(logs) != 10*200-1 {
+		t.Errorf("unexpected number of logs: %d", len(logs))
+	}
+	for _, log := range logs {
+		var cLog contextLog
+		if err := json.Unmarshal([]byte(log), &cLog); err != nil {
+			t.Fatalf("broken log %q: %v", log, err)
+		}
+	}
+}
+
+func TestRecoverPanic(t *testing.T) {
+	for _, repanic := range []bool{false, true} {
+		t.Run(fmt.Sprintf("repanic=%v", repanic), func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/foo", nil)
+			w := httptest.NewRecorder()
+
+			requestLogOut := new(bytes.Buffer)
+			contextLogOut := new(bytes.Buffer)
+
+			config := NewConfig("test")
+			config.RequestLogOut = requestLogOut
+			config.ContextLogOut = contextLogOut
+			config.RecoverPanic = true
+			config.Repanic = repanic
+			handler := RequestLogging(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				panic("boom")
+			}))
+
+			func() {
+				defer func() {
+					if p := recover(); (p != nil) != repanic {
+						t.Errorf("unexpected panic: %v", p)
+					}
+				}()
+				handler.ServeHTTP(w, r)
+			}()
+
+			if w.Code != http.StatusInternalServerError {
+				t.Errorf("unexpected status code: %d", w.Code)
+			}
+
+			var httpRequestLog HttpRequestLog
+			if err := json.Unmarshal(requestLogOut.Bytes(), &httpRequestLog); err != nil {
+				t.Fatal(err)
+			}
+			if httpRequestLog.Severity != "CRITICAL" || httpRequestLog.HttpRequest.Status != 500 {
+				t.Errorf("unexpected request log: severity=%s, status=%d", httpRequestLog.Severity, httpRequestLog.HttpRequest.Status)
+			}
+
+			var cLog contextLog
+			if err := json.Unmarshal(contextLogOut.Bytes(), &cLog); err != nil {
+				t.Fatal(err)
+			}
+			if cLog.Severity != "CRITICAL" || !strings.HasPrefix(cLog.Message, "panic: boom\n\ngoroutine ") {
+				t.Errorf("unexpected context log: severity=%s, message=%s", cLog.Severity, cLog.Message)
+			}
+			if cLog.SourceLocation.File != "stackdriver_test.go" {
+				t.Errorf("unexpected source location: %+v", cLog.SourceLocation)
+			}
+		})
+	}
+}
+
+func TestChunkedRequestSize(t *testing.T) {
+	requestLogOut := new(bytes.Buffer)
+	config := NewConfig("test")
+	config.RequestLogOut = requestLogOut
+	config.ContextLogOut = new(bytes.Buffer)
+
+	var headerSize int64
+	done := make(chan struct{})
+	handler := RequestLogging(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength != -1 {
+			t.Errorf("request is not chunked: %d", r.ContentLength)
+		}
+		headerSize = requestHeaderSize(r)
+		io.Copy(io.Discard, r.Body)
+	}))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	// the length of the body is unknown to the client, so it's sent with chunked encoding
+	body := io.MultiReader(strings.NewReader(strings.Repeat("a", 1000)), strings.NewReader(strings.Repeat("b", 1000)))
+	res, err := http.Post(server.URL, "text/plain", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	<-done
+
+	var httpRequestLog HttpRequestLog
+	if err := json.Unmarshal(requestLogOut.Bytes(), &httpRequestLog); err != nil {
+		t.Fatal(err)
+	}
+	if expected := fmt.Sprintf("%d", headerSize+2000); httpRequestLog.HttpRequest.RequestSize != expected {
+		t.Errorf("unexpected request size: got %s, want %s", httpRequestLog.HttpRequest.RequestSize, expected)
+	}
+}
+
+func TestExclude(t *testing.T) {
+	requestLogOut := new(bytes.Buffer)
+	contextLogOut := new(bytes.Buffer)
+
+	config := NewConfig("test")
+	config.RequestLogOut = requestLogOut
+	config.ContextLogOut = contextLogOut
+	config.Exclude = []RequestFilter{
+		PathPrefix("/healthz", "/static/"),
+		PathRegexp(regexp.MustCompile(`^/metrics$`)),
+		func(r *http.Request) bool { return r.Method == "OPTIONS" },
+	}
+	handler := RequestLogging(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		RequestContextLogger(r).Infof("%s %s", r.Method, r.URL.Path)
+	}))
+
+	for _, req := range []struct {
+		method   string
+		path     string
+		excluded bool
+	}{
+		{"GET", "/healthz", true},
+		{"GET", "/static/app.js", true},
+		{"GET", "/metrics", true},
+		{"OPTIONS", "/foo", true},
+		{"GET", "/metrics/foo", false},
+		{"GET", "/foo", false},
+	} {
+		requestLogOut.Reset()
+		contextLogOut.Reset()
+		r, _ := http.NewRequest(req.method, req.path, nil)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+
+		if excluded := requestLogOut.Len() == 0; excluded != req.excluded {
+			t.Errorf("%s %s: excluded=%v, want %v", req.method, req.path, excluded, req.excluded)
+		}
+		var cLog contextLog
+		if err := json.Unmarshal(contextLogOut.Bytes(), &cLog); err != nil {
+			t.Fatalf("%s %s: %v", req.method, req.path, err)
+		}
+		if !strings.HasPrefix(cLog.Trace, "projects/test/traces/") {
+			t.Errorf("%s %s: unexpected trace: %s", req.method, req.path, cLog.Trace)
+		}
+	}
+}
+
+func TestSourceLocation(t *testing.T) {
+	out := new(bytes.Buffer)
+	logger := &ContextLogger{sink: NewWriterSink(out), Severity: SeverityInfo}
+
+	_, _, line, _ := runtime.Caller(0)
+	logger.Infof("plain")
+	logger.InfoKV("kv", "key", "value")
+	logger.With(Fields{"key": "value"}).Infof("with")
+
+	logs := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(logs) != 3 {
+		t.Fatalf("unexpected number of logs: %d", len(logs))
+	}
+	for idx, log := range logs {
+		var cLog contextLog
+		if err := json.Unmarshal([]byte(log), &cLog); err != nil {
+			t.Fatal(err)
+		}
+		expected := SourceLocation{
+			File:     "stackdriver_test.go",
+			Line:     fmt.Sprintf("%d", line+1+idx),
+			Function: packagePath + ".TestSourceLocation",
+		}
+		if cLog.SourceLocation != expected {
+			t.Errorf("%s: got %+v, want %+v", cLog.Message, cLog.SourceLocation, expected)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+// Package stackdriverlogtest provides utilities to test code which logs with stackdriverlog.
+//
+//	recorder := stackdriverlogtest.NewRecorder()
+//	config := stackdriverlog.NewConfig("test")
+//	recorder.Attach(config)
+//	handler := stackdriverlog.RequestLogging(config)(myHandler)
+//	...
+//	recorder.RequestFor("/foo").AssertLogged(t, stackdriverlog.SeverityError, "failed")
+package stackdriverlogtest
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	log "github.com/yfuruyama/stackdriver-request-context-log"
+)
+
+// Recorder is the sink which records log entries in memory.
+type Recorder struct {
+	mu      sync.Mutex
+	entries []*log.Entry
+}
+
+// NewRecorder creates a recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// Attach sets the recorder as the sinks of request logs and context logs of the config.
+func (r *Recorder) Attach(config *log.Config) {
+	config.RequestLogSink = r
+	config.ContextLogSink = r
+}
+
+// WriteEntry implements stackdriverlog.Sink
+func (r *Recorder) WriteEntry(entry *log.Entry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, entry)
+	return nil
+}
+
+// Reset removes all recorded entries.
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = nil
+}
+
+// Entries returns all recorded entries in order.
+func (r *Recorder) Entries() []*log.Entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*log.Entry(nil), r.entries...)
+}
+
+// RequestLogs returns the recorded request logs.
+func (r *Recorder) RequestLogs() []*log.Entry {
+	var requests []*log.Entry
+	for _, entry := range r.Entries() {
+		if entry.HttpRequest != nil {
+			requests = append(requests, entry)
+		}
+	}
+	return requests
+}
+
+// ContextLogs returns the recorded context logs.
+func (r *Recorder) ContextLogs() []*log.Entry {
+	var logs []*log.Entry
+	for _, entry := range r.Entries() {
+		if entry.HttpRequest == nil {
+			logs = append(logs, entry)
+		}
+	}
+	return logs
+}
+
+// Group is a request log and the context logs of the same trace.
+type Group struct {
+	Trace string
+
+	// Request is nil if the request log isn't recorded, e.g. the request is in progress or excluded.
+	Request *log.Entry
+
+	Logs []*log.Entry
+}
+
+// Groups returns the recorded entries grouped by trace, in order of the first entry.
+// Context logs without trace are grouped together with an empty trace.
+func (r *Recorder) Groups() []*Group {
+	var groups []*Group
+	byTrace := make(map[string]*Group)
+	for _, entry := range r.Entries() {
+		g, ok := byTrace[entry.Trace]
+		// a trace may have several requests, e.g. calls between services
+		if !ok || (entry.HttpRequest != nil && g.Request != nil) {
+			g = &Group{Trace: entry.Trace}
+			byTrace[entry.Trace] = g
+			groups = append(groups, g)
+		}
+		if entry.HttpRequest != nil {
+			g.Request = entry
+		} else {
+			g.Logs = append(g.Logs, entry)
+		}
+	}
+	return groups
+}
+
+// RequestFor returns the group of the last request to the path, or nil if not found.
+func (r *Recorder) RequestFor(path string) *Group {
+	groups := r.Groups()
+	for i := len(groups) - 1; i >= 0; i-- {
+		g := groups[i]
+		if g.Request == nil {
+			continue
+		}
+		if u, err := url.ParseRequestURI(g.Request.HttpRequest.RequestUrl); err == nil && u.Path == path {
+			return g
+		}
+	}
+	return nil
+}
+
+// AssertLogged fails the test unless a context log at the severity contains the substring in its message.
+func (r *Recorder) AssertLogged(t testing.TB, severity log.Severity, substring string) {
+	t.Helper()
+	assertLogged(t, r.ContextLogs(), severity, substring)
+}
+
+// AssertLogged fails the test unless a context log of the group at the severity contains the substring in its message.
+// It also fails if the group is nil, so it can be chained with `Recorder.RequestFor`.
+func (g *Group) AssertLogged(t testing.TB, severity log.Severity, substring string) {
+	t.Helper()
+	if g == nil {
+		t.Errorf("no request is recorded to assert %s log %q", severity, substring)
+		return
+	}
+	assertLogged(t, g.Logs, severity, substring)
+}
+
+func assertLogged(t testing.TB, entries []*log.Entry, severity log.Severity, substring string) {
+	t.Helper()
+	for _, entry := range entries {
+		if entry.Severity == severity && strings.Contains(entry.Message(), substring) {
+			return
+		}
+	}
+	var logged []string
+	for _, entry := range entries {
+		logged = append(logged, entry.Severity.String()+": "+entry.Message())
+	}
+	t.Errorf("no %s log contains %q, logged:\n%s", severity, substring, strings.Join(logged, "\n"))
+}
+
+// NewTestLogger creates a context logger which records logs at any severity for tests.
+// The logger can be put in a request context with `stackdriverlog.NewContext` to test handlers without the middleware.
+// Logs are also written to the test log, which is shown when the test fails or with -v.
+func NewTestLogger(t testing.TB) (*log.ContextLogger, *Recorder) {
+	recorder := NewRecorder()
+	config := log.NewConfig("test")
+	config.Severity = log.SeverityDefault
+	sink := &testSink{t: t, recorder: recorder, console: log.NewConsoleSink(nil, log.ConsoleConfig{NoColor: true})}
+	t.Cleanup(func() {
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		sink.done = true
+	})
+	config.ContextLogSink = sink
+	return log.NewContextLogger(config), recorder
+}
+
+// testSink writes entries to the test log and the recorder.
+// Entries written after the test finishes, e.g. by leaked goroutines, are only recorded
+// because t.Log panics after the test.
+type testSink struct {
+	t        testing.TB
+	recorder *Recorder
+	console  *log.ConsoleSink
+
+	mu   sync.Mutex // guards done, held while logging to the test log
+	done bool
+}
+
+func (s *testSink) WriteEntry(entry *log.Entry) error {
+	s.t.Helper()
+	s.mu.Lock()
+	if !s.done {
+		s.t.Log(strings.TrimSuffix(s.console.FormatEntry(entry, true, ""), "\n"))
+	}
+	s.mu.Unlock()
+	return s.recorder.WriteEntry(entry)
+}
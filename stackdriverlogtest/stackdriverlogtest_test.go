@@ -0,0 +1,106 @@
+package stackdriverlogtest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	log "github.com/yfuruyama/stackdriver-request-context-log"
+)
+
+func TestRecorder(t *testing.T) {
+	recorder := NewRecorder()
+	config := log.NewConfig("test")
+	recorder.Attach(config)
+
+	handler := log.RequestLogging(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := log.RequestContextLogger(r)
+		logger.Infof("hello %s", r.URL.Path)
+		if r.URL.Path == "/bar" {
+			logger.Errorf("failed to get bar")
+		}
+	}))
+	for _, path := range []string{"/foo", "/bar?x=1"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	groups := recorder.Groups()
+	if len(groups) != 2 {
+		t.Fatalf("unexpected number of groups: %d", len(groups))
+	}
+	for _, g := range groups {
+		if g.Request == nil || g.Trace == "" || g.Request.Trace != g.Trace {
+			t.Errorf("unexpected group: %+v", g)
+		}
+	}
+	if len(recorder.RequestLogs()) != 2 || len(recorder.ContextLogs()) != 3 {
+		t.Errorf("unexpected number of entries: %d request logs, %d context logs", len(recorder.RequestLogs()), len(recorder.ContextLogs()))
+	}
+
+	bar := recorder.RequestFor("/bar")
+	if bar == nil {
+		t.Fatal("request to /bar is not found")
+	}
+	if bar.Request.Severity != log.SeverityError {
+		t.Errorf("unexpected severity: %s", bar.Request.Severity)
+	}
+	bar.AssertLogged(t, log.SeverityError, "failed")
+	recorder.AssertLogged(t, log.SeverityInfo, "hello /foo")
+	if recorder.RequestFor("/baz") != nil {
+		t.Error("unexpected request to /baz")
+	}
+
+	// failures are reported to the test
+	fake := &fakeT{}
+	bar.AssertLogged(fake, log.SeverityError, "hello")
+	recorder.RequestFor("/baz").AssertLogged(fake, log.SeverityInfo, "hello")
+	if fake.errors != 2 {
+		t.Errorf("unexpected number of failures: %d", fake.errors)
+	}
+
+	recorder.Reset()
+	if len(recorder.Entries()) != 0 {
+		t.Error("entries are not reset")
+	}
+}
+
+func TestNewTestLogger(t *testing.T) {
+	logger, recorder := NewTestLogger(t)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.RequestContextLogger(r).With(log.Fields{"user": "alice"}).Debugf("debug")
+	})
+	r := httptest.NewRequest("GET", "/", nil)
+	r = r.WithContext(log.NewContext(r.Context(), logger))
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	recorder.AssertLogged(t, log.SeverityDebug, "debug")
+	expected := map[string]interface{}{"message": "debug", "user": "alice"}
+	if got := recorder.Entries()[0].Payload; !cmp.Equal(got, expected) {
+		t.Errorf("diff: %s", cmp.Diff(got, expected))
+	}
+}
+
+// fakeT counts failures
+type fakeT struct {
+	testing.TB
+	errors int
+}
+
+func (t *fakeT) Helper() {}
+
+func (t *fakeT) Errorf(format string, args ...interface{}) {
+	t.errors++
+}
+
+func TestNewTestLoggerAfterTest(t *testing.T) {
+	var logger *log.ContextLogger
+	var recorder *Recorder
+	t.Run("leak", func(t *testing.T) {
+		logger, recorder = NewTestLogger(t)
+	})
+
+	// logging after the test finishes must not panic
+	logger.Infof("late")
+	recorder.AssertLogged(t, log.SeverityInfo, "late")
+}